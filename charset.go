@@ -0,0 +1,127 @@
+package pixbooster
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// Number of bytes looked at to find the encoding of a page, as in the
+// encoding sniffing algorithm of the HTML standard.
+const charsetPrescanSize = 1024
+
+// Encodings in which ASCII bytes don't always stand for ASCII characters, so
+// that markup can't be tokenized before being decoded.
+var nonASCIIEncodings = map[string]bool{
+	"utf-16be":    true,
+	"utf-16le":    true,
+	"iso-2022-jp": true,
+}
+
+// Byte order marks, which take precedence over any declared encoding.
+var byteOrderMarks = [][]byte{
+	{0xef, 0xbb, 0xbf},
+	{0xfe, 0xff},
+	{0xff, 0xfe},
+}
+
+// rewriteEncodedHTML rewrites a page in any encoding. The encoding is found
+// from its byte order mark, the charset of contentType or its <meta>
+// elements. Pages in an ASCII-compatible encoding are tokenized as they are,
+// so that the bytes not rewritten are kept as is. Others are transcoded to
+// be tokenized, then written back in their original encoding, so that the
+// header and <meta> elements still match.
+func (p *Pixbooster) rewriteEncodedHTML(w io.Writer, r io.Reader, contentType string) error {
+	br := bufio.NewReaderSize(r, charsetPrescanSize)
+	head, _ := br.Peek(charsetPrescanSize)
+
+	enc, name := pageEncoding(head, contentType)
+	switch {
+	case enc == encoding.Nop || name == "utf-8":
+		return p.rewriteHTML(w, br, nil)
+	case name == "replacement":
+		// Decoded as a single replacement character, on purpose.
+		_, err := io.Copy(w, br)
+		return err
+	case !nonASCIIEncodings[name]:
+		return p.rewriteHTML(w, br, enc)
+	}
+	p.logger.Debug("Transcoding page", zap.String("charset", name))
+
+	// The decoder drops the byte order mark, and the encoder doesn't write
+	// it back: keep it as is.
+	for _, bom := range byteOrderMarks {
+		if bytes.HasPrefix(head, bom) {
+			if _, err := w.Write(bom); err != nil {
+				return err
+			}
+			br.Discard(len(bom))
+			break
+		}
+	}
+
+	// Characters added by the rewrite which can't be encoded are written
+	// as character references.
+	encoder := transform.NewWriter(w, encoding.HTMLEscapeUnsupported(enc.NewEncoder()))
+	if err := p.rewriteHTML(encoder, transform.NewReader(br, enc.NewDecoder()), nil); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+// pageEncoding returns the encoding of a page starting with head, as declared
+// by its byte order mark, the charset of contentType or a <meta> element in
+// head, in that order. Without any declaration, the page is taken as UTF-8:
+// guessing from the first bytes only, as browsers do, would mistake a UTF-8
+// fragment starting with ASCII for windows-1252.
+func pageEncoding(head []byte, contentType string) (encoding.Encoding, string) {
+	if enc, name, certain := charset.DetermineEncoding(head, contentType); certain {
+		return enc, name
+	}
+	if enc, name := charset.Lookup(metaCharset(head)); enc != nil {
+		// A page read as bytes can't be in UTF-16, whatever it declares.
+		if name == "utf-16be" || name == "utf-16le" {
+			return encoding.Nop, "utf-8"
+		}
+		return enc, name
+	}
+	return encoding.Nop, "utf-8"
+}
+
+// metaCharset returns the charset declared by the first <meta charset> or
+// <meta http-equiv="Content-Type"> element of head, if any.
+func metaCharset(head []byte) string {
+	z := html.NewTokenizer(bytes.NewReader(head))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return ""
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := z.Token()
+		if token.Data != "meta" {
+			continue
+		}
+		if label, ok := tokenAttr(token, "charset"); ok {
+			return strings.TrimSpace(label)
+		}
+		httpEquiv, _ := tokenAttr(token, "http-equiv")
+		content, _ := tokenAttr(token, "content")
+		if strings.EqualFold(httpEquiv, "content-type") {
+			if _, params, err := mime.ParseMediaType(content); err == nil && params["charset"] != "" {
+				return params["charset"]
+			}
+		}
+	}
+}
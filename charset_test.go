@@ -0,0 +1,108 @@
+package pixbooster
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestPageEncoding(t *testing.T) {
+	tests := []struct {
+		name        string
+		head        string
+		contentType string
+		want        string
+	}{
+		{"nothing declared", `<div><img src="a.jpg"></div>`, "text/html", "utf-8"},
+		{"header", `<p>`, "text/html; charset=Shift_JIS", "shift_jis"},
+		{"meta charset", `<meta charset="windows-1252">`, "text/html", "windows-1252"},
+		{"meta http-equiv", `<meta http-equiv="Content-Type" content="text/html; charset=euc-jp">`, "text/html", "euc-jp"},
+		{"header over meta", `<meta charset="windows-1252">`, "text/html; charset=shift_jis", "shift_jis"},
+		{"byte order mark over header", "\xef\xbb\xbf<p>", "text/html; charset=shift_jis", "utf-8"},
+		{"utf-16 byte order mark", "\xff\xfe<\x00p\x00>\x00", "text/html", "utf-16le"},
+		{"meta declaring utf-16", `<meta charset="utf-16">`, "text/html", "utf-8"},
+	}
+	for _, test := range tests {
+		if _, got := pageEncoding([]byte(test.head), test.contentType); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRewriteUndeclaredEncoding(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	// A fragment starting with more than 1KiB of ASCII.
+	fragment := `<div>` + strings.Repeat("x", 2000) + `<img src="café.jpg"></div>`
+	want := `<div>` + strings.Repeat("x", 2000) + `<picture>` + testSource(p, "caf%C3%A9.jpg") + `<img src="café.jpg"></picture></div>`
+	w := rewriteTest(t, p, http.Header{"Content-Type": {"text/html"}}, fragment)
+	if got := w.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got[2000:], want[2000:])
+	}
+}
+
+func TestRewriteLegacyEncodings(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+	format := testFormat(p)
+	source := func(srcset string) string {
+		return `<source srcset="` + srcset + `.pixbooster` + format.extension + `" type="` + format.mimeType + `">`
+	}
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().String(`<img src="é.jpg">`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utf16Want, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().String(`<picture>` + source("%C3%A9.jpg") + `<img src="é.jpg"></picture>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		page        string
+		want        string
+	}{
+		{
+			name:        "windows-1252",
+			contentType: "text/html",
+			page:        "<meta charset=\"windows-1252\"><p>caf\xe9</p><img src=\"caf\xe9.jpg\" title=\"caf&eacute;\">",
+			want:        "<meta charset=\"windows-1252\"><p>caf\xe9</p><picture title=\"caf\xe9\">" + source("caf%C3%A9.jpg") + "<img src=\"caf\xe9.jpg\" title=\"caf&eacute;\"></picture>",
+		},
+		{
+			// NEC-selected IBM extensions and invalid bytes wouldn't survive
+			// a round trip through UTF-8.
+			name:        "Shift_JIS",
+			contentType: "text/html; charset=Shift_JIS",
+			page:        "<p>\xed\x40\xfd</p><img src=\"\x8e\xca\x90^.jpg\">",
+			want:        "<p>\xed\x40\xfd</p><picture>" + source("%E5%86%99%E7%9C%9F.jpg") + "<img src=\"\x8e\xca\x90^.jpg\"></picture>",
+		},
+		{
+			name:        "Shift_JIS opted out",
+			contentType: "text/html",
+			page:        "<meta charset=\"Shift_JIS\"><meta name=\"pixbooster\" content=\"off\"><p>\xed\x40\xfd</p><img src=\"a.jpg\">",
+			want:        "<meta charset=\"Shift_JIS\"><meta name=\"pixbooster\" content=\"off\"><p>\xed\x40\xfd</p><img src=\"a.jpg\">",
+		},
+		{
+			name:        "byte order mark over header",
+			contentType: "text/html; charset=Shift_JIS",
+			page:        "\xef\xbb\xbf<img src=\"café.jpg\">",
+			want:        "\xef\xbb\xbf<picture>" + source("caf%C3%A9.jpg") + "<img src=\"café.jpg\"></picture>",
+		},
+		{
+			name:        "UTF-16",
+			contentType: "text/html",
+			page:        "\xff\xfe" + utf16,
+			want:        "\xff\xfe" + utf16Want,
+		},
+	}
+	for _, test := range tests {
+		w := rewriteTest(t, p, http.Header{"Content-Type": {test.contentType}}, test.page)
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("%s: got:\n%q\nwant:\n%q", test.name, got, test.want)
+		}
+	}
+}
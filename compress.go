@@ -0,0 +1,100 @@
+package pixbooster
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings of the pages which can be rewritten.
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+	encodingBrotli  = "br"
+	encodingZstd    = "zstd"
+)
+
+func isSupportedEncoding(encoding string) bool {
+	switch encoding {
+	case encodingGzip, encodingDeflate, encodingBrotli, encodingZstd:
+		return true
+	default:
+		return false
+	}
+}
+
+// contentEncoding returns the encoding of a response, or an empty string if
+// it isn't encoded.
+func contentEncoding(header http.Header) string {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// weakenETag marks the entity tag of a rewritten response as weak: the page
+// is semantically the same, but not byte for byte anymore.
+func weakenETag(header http.Header) {
+	etag := header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// flushWriter is implemented by the compressors.
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newDecoder returns a reader decompressing r, encoded with encoding.
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewReader(r)
+	case encodingDeflate:
+		// Deflate is meant to be wrapped in zlib, but some servers send it
+		// raw.
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case encodingBrotli:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case encodingZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// newEncoder returns a writer compressing to w with encoding.
+func newEncoder(encoding string, w io.Writer) (flushWriter, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingDeflate:
+		return zlib.NewWriter(w), nil
+	case encodingBrotli:
+		return brotli.NewWriter(w), nil
+	case encodingZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
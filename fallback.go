@@ -0,0 +1,129 @@
+package pixbooster
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Behaviors when an image can't be converted.
+const (
+	// Answer with a 500 Internal Server Error.
+	onErrorError = "error"
+	// Redirect the client to the original image.
+	onErrorRedirect = "redirect"
+	// Send the original image in place of the optimized one.
+	onErrorOriginal = "original"
+)
+
+func isValidOnError(onError string) bool {
+	switch onError {
+	case onErrorError, onErrorRedirect, onErrorOriginal:
+		return true
+	default:
+		return false
+	}
+}
+
+// failureCache remembers the variants whose conversion failed recently, so
+// that a broken original image isn't decoded again on every request.
+type failureCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newFailureCache() *failureCache {
+	return &failureCache{entries: make(map[string]time.Time)}
+}
+
+func (f *failureCache) add(key string, ttl time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for k, expiry := range f.entries {
+		if now.After(expiry) {
+			delete(f.entries, k)
+		}
+	}
+	f.entries[key] = now.Add(ttl)
+}
+
+func (f *failureCache) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	expiry, ok := f.entries[key]
+	if ok && time.Now().After(expiry) {
+		delete(f.entries, key)
+		return false
+	}
+	return ok
+}
+
+// serveConversionFailure answers a request whose optimized image can't be
+// produced, according to the OnError setting.
+func (p *Pixbooster) serveConversionFailure(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, originalURI string) error {
+	switch p.OnError {
+	case onErrorRedirect:
+		return p.serveOriginal(w, r, next, originalURI, false)
+	case onErrorOriginal:
+		return p.serveOriginal(w, r, next, originalURI, true)
+	default:
+		return p.serveUnconverted(w, r, next, originalURI, http.StatusInternalServerError)
+	}
+}
+
+// serveUnconverted answers with status a request whose optimized image can't
+// be produced. Requests already targeting the original image, like negotiated
+// ones, are passed to the next handlers instead.
+func (p *Pixbooster) serveUnconverted(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, originalURI string, status int) error {
+	if p.targetsOriginal(r, next, originalURI) {
+		return next.ServeHTTP(w, r)
+	}
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	http.Error(w, http.StatusText(status), status)
+	return nil
+}
+
+// targetsOriginal tells whether r requests the original image located at
+// originalURI, and can be passed to the next handlers to get it.
+func (p *Pixbooster) targetsOriginal(r *http.Request, next caddyhttp.Handler, originalURI string) bool {
+	// The query of originalURI may have been filtered by the query policy.
+	originalPath, _, _ := strings.Cut(originalURI, "?")
+	return next != nil && r.URL.EscapedPath() == originalPath
+}
+
+// serveOriginal sends the client to the original image instead of an
+// optimized one, either with a redirect or by streaming its content.
+// Requests already targeting the original image, like negotiated ones, are
+// passed to the next handlers instead.
+func (p *Pixbooster) serveOriginal(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, originalURI string, stream bool) error {
+	if p.targetsOriginal(r, next, originalURI) {
+		return next.ServeHTTP(w, r)
+	}
+
+	if stream {
+		original, err := p.loadOriginal(r, next, originalURI)
+		if err == nil {
+			w.Header().Set("Content-Type", original.contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(original.data)))
+			// Don't let caches keep the original image under the URL of
+			// the optimized one.
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			if r.Method != http.MethodHead {
+				w.Write(original.data)
+			}
+			return nil
+		}
+		p.logger.Error("Error loading original image, redirecting: " + err.Error())
+	}
+
+	http.Redirect(w, r, originalURI, http.StatusTemporaryRedirect)
+	return nil
+}
@@ -0,0 +1,85 @@
+package pixbooster
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestFailureCache(t *testing.T) {
+	f := newFailureCache()
+	f.add("a", time.Minute)
+	f.add("b", -time.Second)
+	if !f.has("a") {
+		t.Error("a failure within its TTL is forgotten")
+	}
+	if f.has("b") || f.has("c") {
+		t.Error("an expired or unknown failure is remembered")
+	}
+	// Expired entries are dropped on the next addition.
+	f.add("c", -time.Second)
+	f.add("d", time.Minute)
+	if len(f.entries) != 2 {
+		t.Errorf("got %d entries, want 2", len(f.entries))
+	}
+}
+
+func TestOnError(t *testing.T) {
+	broken := []byte("not an image")
+	tests := []struct {
+		onError string
+		check   func(t *testing.T, code int, header http.Header, body []byte)
+	}{
+		{onErrorRedirect, func(t *testing.T, code int, header http.Header, body []byte) {
+			if code != http.StatusTemporaryRedirect || header.Get("Location") != "/broken.jpg" {
+				t.Errorf("got status %d to %q, want a redirect to /broken.jpg", code, header.Get("Location"))
+			}
+		}},
+		{onErrorOriginal, func(t *testing.T, code int, header http.Header, body []byte) {
+			if code != http.StatusOK || string(body) != string(broken) || header.Get("Cache-Control") != "no-cache" {
+				t.Errorf("got status %d, body %q and Cache-Control %q, want the original image", code, body, header.Get("Cache-Control"))
+			}
+		}},
+		{onErrorError, func(t *testing.T, code int, header http.Header, body []byte) {
+			if code != http.StatusInternalServerError {
+				t.Errorf("got status %d, want 500", code)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.onError, func(t *testing.T) {
+			p := &Pixbooster{OnError: test.onError}
+			root, original := provisionTest(t, p)
+			if err := os.WriteFile(filepath.Join(root, "broken.jpg"), broken, 0644); err != nil {
+				t.Fatal(err)
+			}
+			format := testFormat(p)
+
+			fetches := 0
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if r.Method == http.MethodGet {
+					fetches++
+				}
+				return original.ServeHTTP(w, r)
+			})
+
+			for i := 0; i < 2; i++ {
+				w := serveTest(t, p, next, http.MethodGet, "/broken.jpg.pixbooster"+format.extension, nil)
+				test.check(t, w.Code, w.Header(), w.Body.Bytes())
+			}
+			// The failure is remembered: only the original image streamed
+			// in place of the variant is fetched again.
+			want := 1
+			if test.onError == onErrorOriginal {
+				want = 3
+			}
+			if fetches != want {
+				t.Errorf("the original image was fetched %d times, want %d", fetches, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package pixbooster
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errConversionTimeout is returned to the requests given up waiting for a
+// conversion run by another request.
+var errConversionTimeout = errors.New("timeout waiting for a concurrent conversion")
+
+// flightGroup coalesces concurrent calls sharing the same key, so that a
+// variant requested by many clients at once is only converted once.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// do runs fn unless a call with the same key is already running, in which
+// case it waits at most timeout for the result of that call. The returned
+// boolean tells if the result comes from another call.
+func (g *flightGroup) do(key string, timeout time.Duration, fn func() ([]byte, error)) ([]byte, bool, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-call.done:
+			return call.data, true, call.err
+		case <-timer.C:
+			return nil, true, errConversionTimeout
+		}
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.data, call.err = fn()
+	return call.data, false, call.err
+}
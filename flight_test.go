@@ -0,0 +1,75 @@
+package pixbooster
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fn := func() ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte("variant"), nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	var shared atomic.Int32
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, fromOther, err := g.do("key", time.Minute, fn)
+			if err != nil || !bytes.Equal(data, []byte("variant")) {
+				t.Errorf("got %q, %v", data, err)
+			}
+			if fromOther {
+				shared.Add(1)
+			}
+		}()
+	}
+	// Give every caller the time to join the running call.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 || shared.Load() != callers-1 {
+		t.Errorf("fn called %d times, %d shared results, want 1 and %d", calls.Load(), shared.Load(), callers-1)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("%d calls left in the group", len(g.calls))
+	}
+}
+
+func TestFlightGroupTimeout(t *testing.T) {
+	g := newFlightGroup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.do("key", time.Minute, func() ([]byte, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+	}()
+	<-started
+
+	_, fromOther, err := g.do("key", 10*time.Millisecond, func() ([]byte, error) {
+		t.Error("fn called while another call is running")
+		return nil, nil
+	})
+	if !fromOther || !errors.Is(err, errConversionTimeout) {
+		t.Errorf("got %t, %v, want errConversionTimeout from the running call", fromOther, err)
+	}
+	close(release)
+	<-done
+}
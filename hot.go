@@ -0,0 +1,86 @@
+package pixbooster
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// hotCache keeps the most recently served variants in memory, along with
+// their response headers, within a budget in bytes. The storage stays the
+// source of truth: entries are dropped whenever the stored variant is
+// replaced or removed.
+type hotCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	entries map[string]*list.Element
+	// Most recently used entries are at the front.
+	order *list.List
+	size  int64
+}
+
+type hotEntry struct {
+	key     string
+	header  http.Header
+	data    []byte
+	modTime time.Time
+}
+
+// newHotCache returns a cache holding up to maxSize bytes. A zero maxSize
+// disables it.
+func newHotCache(maxSize int64) *hotCache {
+	return &hotCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (h *hotCache) get(key string) (*hotEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	elem, ok := h.entries[key]
+	if !ok {
+		return nil, false
+	}
+	h.order.MoveToFront(elem)
+	return elem.Value.(*hotEntry), true
+}
+
+// put adds an entry, evicting the least recently used ones to fit the
+// budget. Entries larger than a quarter of the budget aren't kept, so that a
+// single large image can't flush the whole cache.
+func (h *hotCache) put(entry *hotEntry) {
+	size := int64(len(entry.data))
+	if size > h.maxSize/4 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if elem, ok := h.entries[entry.key]; ok {
+		h.size -= int64(len(elem.Value.(*hotEntry).data))
+		h.order.Remove(elem)
+	}
+	h.entries[entry.key] = h.order.PushFront(entry)
+	h.size += size
+
+	for h.size > h.maxSize {
+		elem := h.order.Back()
+		evicted := elem.Value.(*hotEntry)
+		h.size -= int64(len(evicted.data))
+		h.order.Remove(elem)
+		delete(h.entries, evicted.key)
+	}
+}
+
+func (h *hotCache) remove(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if elem, ok := h.entries[key]; ok {
+		h.size -= int64(len(elem.Value.(*hotEntry).data))
+		h.order.Remove(elem)
+		delete(h.entries, key)
+	}
+}
@@ -0,0 +1,43 @@
+package pixbooster
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestHotHit(t *testing.T) {
+	p := &Pixbooster{MemoryCacheSize: 1 << 20}
+	root, files := provisionTest(t, p)
+	if err := os.WriteFile(filepath.Join(root, "b.jpg"), testJPEG(t, 32, 32), 0644); err != nil {
+		t.Fatal(err)
+	}
+	format := testFormat(p)
+	var heads int
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method == http.MethodHead {
+			heads++
+		}
+		return files.ServeHTTP(w, r)
+	})
+
+	serveTest(t, p, next, http.MethodGet, "/a.jpg.pixbooster"+format.extension, nil)
+	serveTest(t, p, next, http.MethodGet, "/b.jpg.pixbooster"+format.extension, nil)
+	w := serveTest(t, p, next, http.MethodGet, "/a.jpg.pixbooster"+format.extension, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	if heads != 2 {
+		t.Errorf("original images fingerprinted %d times, want 2", heads)
+	}
+
+	// a.jpg was served last from memory, b.jpg is the least recently used.
+	_, size := p.cacheIndex.usage()
+	victims := p.cacheIndex.victims(size-1, 0)
+	if len(victims) != 1 || `"`+victims[0]+`"` == w.Header().Get("ETag") {
+		t.Errorf("evicted %v, want the variant of b.jpg only", victims)
+	}
+}
@@ -0,0 +1,88 @@
+package pixbooster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errLimitExceeded is returned when an original image exceeds the configured
+// limits. It is served as is instead of being converted.
+var errLimitExceeded = errors.New("image limit exceeded")
+
+// Default limits of the original images, bounding the memory and the time
+// taken by a conversion.
+const (
+	defaultMaxInputSize      = 32 << 20
+	defaultMaxPixels         = 50_000_000
+	defaultMaxDimension      = 16384
+	defaultConversionTimeout = time.Minute
+)
+
+// checkInputSize checks the size in bytes of an original image.
+func (p *Pixbooster) checkInputSize(size int64) error {
+	if size > p.MaxInputSize {
+		return fmt.Errorf("%w: %d bytes, max_input_size is %d", errLimitExceeded, size, p.MaxInputSize)
+	}
+	return nil
+}
+
+// checkImageLimits checks the dimensions of an original image from its
+// header, before it is decoded: a small file may claim billions of pixels.
+// It returns the header.
+func (p *Pixbooster) checkImageLimits(data []byte) (image.Config, error) {
+	if err := p.checkInputSize(int64(len(data))); err != nil {
+		return image.Config{}, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return image.Config{}, err
+	}
+	if config.Width > p.MaxDimension || config.Height > p.MaxDimension {
+		return image.Config{}, fmt.Errorf("%w: %dx%d pixels, max_dimension is %d", errLimitExceeded, config.Width, config.Height, p.MaxDimension)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > p.MaxPixels {
+		return image.Config{}, fmt.Errorf("%w: %d pixels, max_pixels is %d", errLimitExceeded, pixels, p.MaxPixels)
+	}
+	return config, nil
+}
+
+// convertWithTimeout converts original like convertImageToFormat, giving up
+// after ConversionTimeout. The encoders can't be interrupted: a conversion
+// given up keeps running in the background, and only releases its encoder
+// once done. A panicking conversion, out of the request goroutine, would
+// take the whole server down: it is turned into an error.
+func (p *Pixbooster) convertWithTimeout(original *originalImage, format imgFormat, transform imgTransform) (io.Reader, error) {
+	type result struct {
+		img io.Reader
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() {
+			if r := recover(); r != nil {
+				p.logger.Error("Conversion panicked", zap.Any("panic", r), zap.Stack("stack"))
+				res = result{nil, fmt.Errorf("conversion panicked: %v", r)}
+			}
+			p.encoders.release()
+			done <- res
+		}()
+		img, err := p.convertImageToFormat(original, format, transform)
+		res = result{img, err}
+	}()
+
+	timer := time.NewTimer(time.Duration(p.ConversionTimeout))
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.img, res.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: conversion took longer than conversion_timeout (%s)", errLimitExceeded, time.Duration(p.ConversionTimeout))
+	}
+}
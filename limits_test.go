@@ -0,0 +1,80 @@
+package pixbooster
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// testPNGHeader returns the start of a PNG image claiming the given size,
+// without any pixel data.
+func testPNGHeader(width uint32, height uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	chunk := []byte("IHDR")
+	chunk = binary.BigEndian.AppendUint32(chunk, width)
+	chunk = binary.BigEndian.AppendUint32(chunk, height)
+	chunk = append(chunk, 8, 6, 0, 0, 0)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestCheckImageLimits(t *testing.T) {
+	p := &Pixbooster{MaxInputSize: 1 << 20, MaxPixels: 10000, MaxDimension: 200}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		exceeded bool
+	}{
+		{"small image", testJPEG(t, 64, 48), false},
+		{"too many pixels", testJPEG(t, 120, 100), true},
+		{"too wide", testJPEG(t, 201, 1), true},
+		{"decompression bomb", testPNGHeader(50000, 50000), true},
+		{"too large", append(testJPEG(t, 8, 8), make([]byte, 1<<20)...), true},
+	}
+	for _, test := range tests {
+		_, err := p.checkImageLimits(test.data)
+		if test.exceeded != errors.Is(err, errLimitExceeded) {
+			t.Errorf("%s: got %v, want limit exceeded: %v", test.name, err, test.exceeded)
+		}
+	}
+
+	if _, err := p.checkImageLimits([]byte("not an image")); err == nil || errors.Is(err, errLimitExceeded) {
+		t.Errorf("invalid image: got %v, want a decoding error", err)
+	}
+}
+
+func TestCheckInputSize(t *testing.T) {
+	p := &Pixbooster{MaxInputSize: 100}
+	if err := p.checkInputSize(100); err != nil {
+		t.Errorf("got %v for a size at the limit", err)
+	}
+	if err := p.checkInputSize(101); !errors.Is(err, errLimitExceeded) {
+		t.Errorf("got %v, want errLimitExceeded", err)
+	}
+}
+
+func TestConvertWithTimeoutPanic(t *testing.T) {
+	p := &Pixbooster{ConversionTimeout: caddy.Duration(time.Minute), logger: zap.NewNop()}
+	p.encoders = newEncoderPool(1, 0)
+	if _, _, err := p.encoders.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A nil original makes the conversion panic.
+	if _, err := p.convertWithTimeout(nil, imgFormat{}, imgTransform{}); err == nil {
+		t.Error("expected an error from a panicking conversion")
+	}
+	if _, _, err := p.encoders.acquire(context.Background()); err != nil {
+		t.Errorf("encoder not released after a panic: %v", err)
+	}
+}
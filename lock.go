@@ -0,0 +1,57 @@
+package pixbooster
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// variantLocker is implemented by the variant stores shared by several
+// instances, to make sure a variant is only converted by one of them.
+type variantLocker interface {
+	lock(ctx context.Context, key string) error
+	unlock(ctx context.Context, key string) error
+}
+
+func (c certmagicStore) lock(ctx context.Context, key string) error {
+	return c.storage.Lock(ctx, path.Join(storagePrefix, key))
+}
+
+func (c certmagicStore) unlock(ctx context.Context, key string) error {
+	return c.storage.Unlock(ctx, path.Join(storagePrefix, key))
+}
+
+// lockVariant takes the cluster-wide lock of the conversion of the variant
+// stored under key. If another instance stored the variant while waiting for
+// the lock, its content is returned and no lock is held.
+//
+// Stale locks left by crashed instances are taken over by the storage module
+// itself. If the lock still can't be taken within LockTimeout, the
+// conversion goes on without it: concurrent stores of the same variant are
+// harmless, they only waste some CPU.
+func (p *Pixbooster) lockVariant(ctx context.Context, locker variantLocker, key string) ([]byte, func()) {
+	lockCtx, cancel := context.WithTimeout(ctx, time.Duration(p.LockTimeout))
+	defer cancel()
+
+	start := time.Now()
+	if err := locker.lock(lockCtx, key); err != nil {
+		p.logger.Warn("Unable to lock conversion, converting anyway", zap.String("key", key), zap.Error(err))
+		return nil, func() {}
+	}
+	p.logger.Debug("Conversion locked", zap.String("key", key), zap.Duration("wait", time.Since(start)))
+
+	release := func() {
+		if err := locker.unlock(ctx, key); err != nil {
+			p.logger.Warn("Unable to unlock conversion", zap.String("key", key), zap.Error(err))
+		}
+	}
+
+	if data, _, err := p.loadVariant(ctx, key); err == nil {
+		p.logger.Debug("Variant stored by another instance", zap.String("key", key))
+		release()
+		return data, func() {}
+	}
+	return nil, release
+}
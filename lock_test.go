@@ -0,0 +1,77 @@
+package pixbooster
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+func TestLockVariantStoredByAnotherInstance(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	store := certmagicStore{storage: storage}
+	p.variants = store
+
+	// Another instance holds the lock while converting the variant.
+	ctx := context.Background()
+	if err := storage.Lock(ctx, path.Join(storagePrefix, "variant")); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		data    []byte
+		release func()
+	}
+	done := make(chan result)
+	go func() {
+		data, release := p.lockVariant(ctx, store, "variant")
+		done <- result{data, release}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := store.store(ctx, "variant", []byte("stored elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Unlock(ctx, path.Join(storagePrefix, "variant")); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if string(res.data) != "stored elsewhere" {
+		t.Errorf("got %q, want the variant stored by the other instance", res.data)
+	}
+	res.release()
+	// No lock is held: it can be taken right away.
+	lockCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := storage.Lock(lockCtx, path.Join(storagePrefix, "variant")); err != nil {
+		t.Errorf("the lock is still held: %v", err)
+	} else {
+		storage.Unlock(ctx, path.Join(storagePrefix, "variant"))
+	}
+}
+
+func TestLockVariantTimeout(t *testing.T) {
+	p := &Pixbooster{LockTimeout: caddy.Duration(50 * time.Millisecond)}
+	provisionTest(t, p)
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	store := certmagicStore{storage: storage}
+	p.variants = store
+
+	ctx := context.Background()
+	if err := storage.Lock(ctx, path.Join(storagePrefix, "variant")); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Unlock(ctx, path.Join(storagePrefix, "variant"))
+
+	// The conversion goes on without the lock.
+	data, release := p.lockVariant(ctx, store, "variant")
+	if data != nil {
+		t.Errorf("got %q, want nothing to convert the variant", data)
+	}
+	release()
+}
@@ -0,0 +1,220 @@
+package pixbooster
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+// How often the storage is checked for entries to evict.
+const evictionInterval = time.Minute
+
+// cacheIndex keeps track of the stored variants in least recently used
+// order, so that the storage can be bounded without rescanning it.
+type cacheIndex struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// Most recently used entries are at the front.
+	order *list.List
+	size  int64
+}
+
+type cacheEntry struct {
+	key     string
+	size    int64
+	created time.Time
+}
+
+func newCacheIndex() *cacheIndex {
+	return &cacheIndex{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// add records a stored variant, or updates it if already known.
+func (c *cacheIndex) add(key string, size int64, created time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		c.size += size - entry.size
+		entry.size = size
+		entry.created = created
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, size: size, created: created})
+	c.size += size
+}
+
+// addScanned records a variant found in the storage as the least recently
+// used one, unless already known.
+func (c *cacheIndex) addScanned(key string, size int64, created time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushBack(&cacheEntry{key: key, size: size, created: created})
+	c.size += size
+}
+
+// touch marks a variant as just used.
+func (c *cacheIndex) touch(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+	}
+}
+
+// created returns when a variant was stored, as far as the index knows.
+func (c *cacheIndex) created(key string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		return elem.Value.(*cacheEntry).created, true
+	}
+	return time.Time{}, false
+}
+
+func (c *cacheIndex) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.size -= elem.Value.(*cacheEntry).size
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// usage returns the number of variants and their total size in bytes.
+func (c *cacheIndex) usage() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.size
+}
+
+// victims removes from the index and returns the keys of the entries older
+// than ttl, then of the least recently used entries until the total size
+// fits in maxSize. Zero values disable the matching limit.
+func (c *cacheIndex) victims(maxSize int64, ttl time.Duration) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	evict := func(elem *list.Element) {
+		entry := elem.Value.(*cacheEntry)
+		c.size -= entry.size
+		c.order.Remove(elem)
+		delete(c.entries, entry.key)
+		keys = append(keys, entry.key)
+	}
+
+	if ttl > 0 {
+		deadline := time.Now().Add(-ttl)
+		for elem := c.order.Front(); elem != nil; {
+			following := elem.Next()
+			if elem.Value.(*cacheEntry).created.Before(deadline) {
+				evict(elem)
+			}
+			elem = following
+		}
+	}
+	if maxSize > 0 {
+		for c.size > maxSize && c.order.Len() > 0 {
+			evict(c.order.Back())
+		}
+	}
+	return keys
+}
+
+// provisionCacheIndex indexes the content of the storage in the background,
+// as a storage module may take a round trip per entry, then logs its usage
+// and starts the eviction if the storage is bounded.
+func (p *Pixbooster) provisionCacheIndex(ctx context.Context) {
+	p.cacheIndex = newCacheIndex()
+	go func() {
+		p.scanStorage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		count, size := p.cacheIndex.usage()
+		p.logger.Info("Pixbooster storage usage",
+			zap.String("storage", p.storageName()),
+			zap.Int("files", count),
+			zap.String("size", humanize.IBytes(uint64(size))),
+		)
+
+		if p.CacheMaxSize > 0 || p.CacheTTL > 0 {
+			p.evictLoop(ctx)
+		}
+	}()
+}
+
+// scanStorage fills the index from the storage, using modification times as
+// a best guess of the access order. Variants stored or used since the scan
+// started stay in front of the scanned ones.
+func (p *Pixbooster) scanStorage(ctx context.Context) {
+	stored, err := p.variants.list(ctx)
+	if err != nil {
+		p.logger.Warn("Unable to scan Pixbooster storage: " + err.Error())
+		return
+	}
+
+	var variants []storedVariant
+	sidecars := make(map[string]int64)
+	for _, variant := range stored {
+		if strings.HasSuffix(variant.key, checksumSuffix) {
+			sidecars[strings.TrimSuffix(variant.key, checksumSuffix)] = variant.size
+		} else {
+			variants = append(variants, variant)
+		}
+	}
+
+	// Most recent first, as each one goes behind the previous ones.
+	sort.Slice(variants, func(i, j int) bool {
+		return variants[i].modTime.After(variants[j].modTime)
+	})
+	for _, variant := range variants {
+		p.cacheIndex.addScanned(variant.key, variant.size+sidecars[variant.key], variant.modTime)
+	}
+}
+
+func (p *Pixbooster) evictLoop(ctx context.Context) {
+	ticker := time.NewTicker(evictionInterval)
+	defer ticker.Stop()
+	for {
+		p.evict(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// evict removes the variants exceeding the configured limits.
+func (p *Pixbooster) evict(ctx context.Context) {
+	keys := p.cacheIndex.victims(int64(p.CacheMaxSize), time.Duration(p.CacheTTL))
+	if len(keys) == 0 {
+		return
+	}
+	for _, key := range keys {
+		p.removeVariant(ctx, key)
+	}
+	count, size := p.cacheIndex.usage()
+	p.logger.Debug("Evicted optimized images",
+		zap.Int("evicted", len(keys)),
+		zap.Int("files", count),
+		zap.String("size", humanize.IBytes(uint64(size))),
+	)
+}
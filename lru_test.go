@@ -0,0 +1,46 @@
+package pixbooster
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCacheIndexVictims(t *testing.T) {
+	c := newCacheIndex()
+	now := time.Now()
+	c.add("a", 10, now)
+	c.add("b", 10, now)
+	c.add("c", 10, now)
+	c.touch("a")
+
+	if got := c.victims(20, 0); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("got victims %v, want [b]", got)
+	}
+	if count, size := c.usage(); count != 2 || size != 20 {
+		t.Errorf("got %d entries of %d bytes, want 2 of 20", count, size)
+	}
+
+	c.add("old", 10, now.Add(-time.Hour))
+	if got := c.victims(0, time.Minute); !slices.Equal(got, []string{"old"}) {
+		t.Errorf("got victims %v, want [old]", got)
+	}
+}
+
+func TestCacheIndexScanKeepsLiveEntries(t *testing.T) {
+	c := newCacheIndex()
+	stored := time.Now()
+	c.add("live", 10, stored)
+
+	// The scan finds the live entry too, along with older ones.
+	c.addScanned("live", 10, stored.Add(-time.Hour))
+	c.addScanned("recent", 10, stored.Add(-2*time.Hour))
+	c.addScanned("old", 10, stored.Add(-3*time.Hour))
+
+	if created, _ := c.created("live"); !created.Equal(stored) {
+		t.Errorf("live entry created at %v, want %v", created, stored)
+	}
+	if got := c.victims(10, 0); !slices.Equal(got, []string{"old", "recent"}) {
+		t.Errorf("got victims %v, want [old recent]", got)
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
-	"net/http"
+	"mime"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/gen2brain/avif"
@@ -26,42 +26,41 @@ func (p *Pixbooster) Provision(ctx caddy.Context) error {
 	p.srcFormats = append(p.srcFormats, imgFormat{extension: ".jpg", mimeType: "image/jpeg"})
 	p.srcFormats = append(p.srcFormats, imgFormat{extension: ".png", mimeType: "image/png"})
 
-	return nil
+	return p.provisionShared(ctx)
 }
 
-func (p *Pixbooster) convertImageToFormat(imgURL string, format imgFormat) (io.Reader, error) {
-	resp, err := http.Get(imgURL)
+func (p *Pixbooster) convertImageToFormat(original *originalImage, format imgFormat, transform imgTransform) (io.Reader, error) {
+	contentType, _, err := mime.ParseMediaType(original.contentType)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid input image content type: %s", original.contentType)
 	}
-	defer resp.Body.Close()
-
-	contentType := resp.Header.Get("Content-Type")
 
 	var img image.Image
 	var decodeErr error
 
 	switch contentType {
 	case "image/jpeg":
-		img, decodeErr = jpeg.Decode(resp.Body)
+		img, decodeErr = jpeg.Decode(bytes.NewReader(original.data))
 	case "image/png":
-		img, decodeErr = png.Decode(resp.Body)
+		img, decodeErr = png.Decode(bytes.NewReader(original.data))
 	case "image/webp":
-		img, decodeErr = webp.Decode(resp.Body)
+		img, decodeErr = webp.Decode(bytes.NewReader(original.data))
 	default:
 		return nil, fmt.Errorf("unsupported input image format: %s", format.extension)
 	}
 	if decodeErr != nil {
 		return nil, decodeErr
 	}
+	img = transformImage(img, transform)
+	_, avifConfig, jxlConfig := p.encoderOptions(transform)
 
 	buf := new(bytes.Buffer)
 
 	switch format.extension {
 	case ".avif":
-		err = avif.Encode(buf, img, p.AvifConfig)
+		err = avif.Encode(buf, img, avifConfig)
 	case ".jxl":
-		err = jpegxl.Encode(buf, img, p.JxlConfig)
+		err = jpegxl.Encode(buf, img, jxlConfig)
 	default:
 		return nil, fmt.Errorf("unsupported output image format: %s", format.extension)
 	}
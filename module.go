@@ -2,28 +2,38 @@ package pixbooster
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 	"github.com/gen2brain/avif"
 	"github.com/gen2brain/jpegxl"
 	"go.uber.org/zap"
-	"golang.org/x/net/html"
 )
 
+// Value of the Retry-After header sent along with 503 responses.
+const retryAfter = "5"
+
 func init() {
 	caddy.RegisterModule(Pixbooster{})
 	httpcaddyfile.RegisterHandlerDirective("pixbooster", parseCaddyfile)
@@ -39,11 +49,31 @@ type Pixbooster struct {
 	cGOEnabled  bool
 	logger      *zap.Logger
 	rootURL     string
+	pageURL     *url.URL
+	baseURL     *url.URL
 	imgSuffix   string
 	destFormats []imgFormat
 	srcFormats  []imgFormat
+
+	trustedOrigins map[string]bool
+	trustedClient  *http.Client
+	guardedClient  *http.Client
+	fingerprints   *fingerprintCache
+	conversions    *flightGroup
+	encoders       *encoderPool
+	failures       *failureCache
+	oversized      *failureCache
+	originalWidths *widthCache
+	cacheIndex     *cacheIndex
+	hotCache       *hotCache
+	variants       variantStore
+
 	// Path where to store the modern image files. Optional.
 	Storage string `json:"storage,omitempty"`
+	// Caddy storage module where to store the modern image files instead of
+	// the Storage directory, e.g. to share them between several instances.
+	// Optional.
+	StorageRaw json.RawMessage `json:"storage_backend,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
 	// Disable Webp output if present.
 	Nowebpoutput bool `json:"nowebpoutput,omitempty"`
 	// Disable treatment of Webp files in the incomming HTML if present.
@@ -65,6 +95,115 @@ type Pixbooster struct {
 	AvifConfig avif.Options `json:"avif_config,omitempty"`
 	// Set specific JXL ouput options.
 	JxlConfig jpegxl.Options `json:"jxl_config,omitempty"`
+
+	// Answer requests for original images with the best modern format
+	// advertised in the Accept header if present.
+	Negotiate bool `json:"negotiate,omitempty"`
+	// How to read the original images: "root" reads the files from the site
+	// root, "subrequest" requests them through the next handlers, "loopback"
+	// requests them over HTTP to the server itself. Default is "subrequest".
+	Source string `json:"source,omitempty"`
+	// Site root used by the "root" source. Default is `{http.vars.root}`.
+	Root string `json:"root,omitempty"`
+	// Origins (scheme://host[:port]) the "loopback" source is allowed to
+	// fetch original images from. If set, any other origin is refused.
+	TrustedOrigins []string `json:"trusted_origins,omitempty"`
+	// Allow the "loopback" source to reach loopback, private and link-local
+	// addresses of origins not listed in TrustedOrigins if present.
+	AllowPrivateOrigins bool `json:"allow_private_origins,omitempty"`
+	// Cache-Control header value sent along with the optimized images,
+	// e.g. "public, max-age=86400". Their URLs don't change when the
+	// original images are replaced, avoid "immutable". Optional.
+	CacheControl string `json:"cache_control,omitempty"`
+	// Maximum time a request waits for the conversion of the same image
+	// already running for another request, and a conversion for a free
+	// encoder. Default is 30s.
+	ConversionWaitTimeout caddy.Duration `json:"conversion_wait_timeout,omitempty"`
+	// Maximum time taken to fetch an original image or its fingerprint.
+	// Default is 30s.
+	FetchTimeout caddy.Duration `json:"fetch_timeout,omitempty"`
+	// Maximum number of images encoded at the same time. Default is the
+	// number of CPUs.
+	MaxConcurrentEncodes int `json:"max_concurrent_encodes,omitempty"`
+	// Maximum number of encodes waiting for a free encoder. Default is 100.
+	MaxEncodeQueue int `json:"max_encode_queue,omitempty"`
+	// What to do when the encode queue is full: "unavailable" answers with
+	// a 503 status, "redirect" sends the client to the original image.
+	// Default is "unavailable".
+	EncodeQueueFull string `json:"encode_queue_full,omitempty"`
+	// What to do when an image can't be converted: "error" answers with a
+	// 500 status, "redirect" redirects the client to the original image,
+	// "original" sends the original image. Default is "redirect".
+	OnError string `json:"on_error,omitempty"`
+	// How long a failed conversion isn't retried. Default is 5m.
+	FailureTTL caddy.Duration `json:"failure_ttl,omitempty"`
+	// Store a checksum along with each optimized image and check it when
+	// reading the image back, discarding corrupted files, if present.
+	VerifyChecksums bool `json:"verify_checksums,omitempty"`
+	// Maximum total size in bytes of the stored images. The least recently
+	// used ones are evicted beyond it. Optional.
+	CacheMaxSize int64 `json:"cache_max_size,omitempty"`
+	// Maximum age of the stored images. Optional.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// Maximum time to wait for another instance converting the same image
+	// when using a storage module, before converting it anyway. Default is
+	// 15s.
+	LockTimeout caddy.Duration `json:"lock_timeout,omitempty"`
+	// Maximum total size in bytes of the optimized images kept in memory to
+	// spare storage reads. Optional.
+	MemoryCacheSize int64 `json:"memory_cache_size,omitempty"`
+	// Content types rewritten in addition to text/html, e.g.
+	// application/xhtml+xml. Other responses are streamed untouched.
+	RewriteContentTypes []string `json:"rewrite_content_types,omitempty"`
+	// Size in bytes beyond which pages are passed through untouched.
+	// Optional.
+	MaxPageSize int64 `json:"max_page_size,omitempty"`
+	// Compress the rewritten pages again with the encoding used by the
+	// upstream, instead of sending them uncompressed for the encode handler
+	// to compress.
+	Recompress bool `json:"recompress,omitempty"`
+	// Response header with which the upstream can ask for a page to be left
+	// alone, with the "off" value, e.g. X-Pixbooster. It is removed from the
+	// responses. Optional.
+	OptOutHeader string `json:"opt_out_header,omitempty"`
+	// Widths in pixels of the resized variants listed in the srcset of the
+	// images, e.g. 320, 640, 1024 and 1600. Images are never upscaled.
+	// Optional.
+	Widths []int `json:"widths,omitempty"`
+	// Sizes attribute of the sources listing resized variants, unless the
+	// image has one. Default is "100vw".
+	Sizes string `json:"sizes,omitempty"`
+	// Only rewrite the pages with a 2xx status.
+	RewriteSuccessOnly bool `json:"rewrite_success_only,omitempty"`
+	// Path prefix of the transformation API, e.g. /_pixbooster. Disabled if
+	// empty.
+	TransformPath string `json:"transform_path,omitempty"`
+	// Also accept the transformation options in the query of the original
+	// images, e.g. /photos/a.jpg?w=800. Requires TransformPath.
+	TransformQuery bool `json:"transform_query,omitempty"`
+	// Keys signing the URLs of the optimized images and of the
+	// transformation API, which are refused without a valid signature. The
+	// first key signs, all of them are accepted, so that keys can be
+	// rotated. Placeholders such as {env.PIXBOOSTER_KEY} are replaced.
+	// Optional.
+	SigningKeys []string `json:"signing_keys,omitempty"`
+	// How the query strings of the image URLs are handled, both in the
+	// cache keys and to fetch the original images: "keep" (default) keeps
+	// them, "ignore" drops them, "allowlist" keeps the QueryAllowlist
+	// parameters only.
+	QueryPolicy string `json:"query_policy,omitempty"`
+	// Query parameters kept by the "allowlist" query policy, e.g. v.
+	QueryAllowlist []string `json:"query_allowlist,omitempty"`
+	// Maximum size in bytes of the original images. Default is 32MiB.
+	MaxInputSize int64 `json:"max_input_size,omitempty"`
+	// Maximum number of pixels of the original images, checked before they
+	// are decoded. Default is 50 million.
+	MaxPixels int64 `json:"max_pixels,omitempty"`
+	// Maximum width or height in pixels of the original images. Default is
+	// 16384.
+	MaxDimension int `json:"max_dimension,omitempty"`
+	// Maximum time taken by a conversion. Default is 1m.
+	ConversionTimeout caddy.Duration `json:"conversion_timeout,omitempty"`
 }
 
 type WebpConfig struct {
@@ -82,24 +221,156 @@ func (Pixbooster) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// provisionShared sets up what is common to CGO and non CGO builds.
+func (p *Pixbooster) provisionShared(ctx caddy.Context) error {
+	if p.Source == "" {
+		p.Source = sourceSubrequest
+	}
+	if !isValidSource(p.Source) {
+		return fmt.Errorf("invalid source value: %s", p.Source)
+	}
+	if p.Root == "" {
+		p.Root = "{http.vars.root}"
+	}
+	for _, width := range p.Widths {
+		if width <= 0 {
+			return fmt.Errorf("invalid widths value: %d", width)
+		}
+	}
+	if p.Sizes == "" {
+		p.Sizes = "100vw"
+	}
+	if p.QueryPolicy == "" {
+		p.QueryPolicy = queryKeep
+	}
+	if !isValidQueryPolicy(p.QueryPolicy) {
+		return fmt.Errorf("invalid query_policy value: %s", p.QueryPolicy)
+	}
+	if p.QueryPolicy == queryAllowlist && len(p.QueryAllowlist) == 0 {
+		return fmt.Errorf("allowlist query_policy without parameters")
+	}
+	repl := caddy.NewReplacer()
+	for i, key := range p.SigningKeys {
+		p.SigningKeys[i] = repl.ReplaceKnown(key, "")
+		if p.SigningKeys[i] == "" {
+			return fmt.Errorf("empty signing key: %s", key)
+		}
+	}
+	p.TransformPath = strings.TrimSuffix(p.TransformPath, "/")
+	if p.TransformPath != "" && !isValidTransformPath(p.TransformPath) {
+		return fmt.Errorf("invalid transform_path value: %s", p.TransformPath)
+	}
+	if p.TransformQuery && p.TransformPath == "" {
+		return fmt.Errorf("transform_query requires transform_path")
+	}
+	if p.ConversionWaitTimeout == 0 {
+		p.ConversionWaitTimeout = caddy.Duration(30 * time.Second)
+	}
+	if p.FetchTimeout <= 0 {
+		p.FetchTimeout = caddy.Duration(30 * time.Second)
+	}
+	p.fingerprints = newFingerprintCache()
+	p.conversions = newFlightGroup()
+	if p.MaxConcurrentEncodes <= 0 {
+		p.MaxConcurrentEncodes = runtime.NumCPU()
+	}
+	if p.MaxEncodeQueue <= 0 {
+		p.MaxEncodeQueue = 100
+	}
+	if p.EncodeQueueFull == "" {
+		p.EncodeQueueFull = queueFullUnavailable
+	}
+	if p.EncodeQueueFull != queueFullUnavailable && p.EncodeQueueFull != queueFullRedirect {
+		return fmt.Errorf("invalid encode_queue_full value: %s", p.EncodeQueueFull)
+	}
+	p.encoders = newEncoderPool(p.MaxConcurrentEncodes, p.MaxEncodeQueue)
+	if p.OnError == "" {
+		p.OnError = onErrorRedirect
+	}
+	if !isValidOnError(p.OnError) {
+		return fmt.Errorf("invalid on_error value: %s", p.OnError)
+	}
+	if p.FailureTTL == 0 {
+		p.FailureTTL = caddy.Duration(5 * time.Minute)
+	}
+	p.failures = newFailureCache()
+	p.oversized = newFailureCache()
+	p.originalWidths = newWidthCache()
+	if p.MaxInputSize <= 0 {
+		p.MaxInputSize = defaultMaxInputSize
+	}
+	if p.MaxPixels <= 0 {
+		p.MaxPixels = defaultMaxPixels
+	}
+	if p.MaxDimension <= 0 {
+		p.MaxDimension = defaultMaxDimension
+	}
+	if p.ConversionTimeout <= 0 {
+		p.ConversionTimeout = caddy.Duration(defaultConversionTimeout)
+	}
+	if p.LockTimeout == 0 {
+		p.LockTimeout = caddy.Duration(15 * time.Second)
+	}
+	if err := p.provisionStorage(ctx); err != nil {
+		return err
+	}
+	p.hotCache = newHotCache(p.MemoryCacheSize)
+	p.provisionCacheIndex(ctx)
+	return p.provisionOrigins()
+}
+
+// provisionStorage sets up the configured variant store.
+func (p *Pixbooster) provisionStorage(ctx caddy.Context) error {
+	if p.StorageRaw == nil {
+		p.variants = fileStore{dir: p.Storage}
+		return nil
+	}
+	mod, err := ctx.LoadModule(p, "StorageRaw")
+	if err != nil {
+		return fmt.Errorf("loading storage module: %v", err)
+	}
+	converter, ok := mod.(caddy.StorageConverter)
+	if !ok {
+		return fmt.Errorf("module %T is not a caddy.StorageConverter", mod)
+	}
+	storage, err := converter.CertMagicStorage()
+	if err != nil {
+		return fmt.Errorf("creating storage value: %v", err)
+	}
+	p.variants = certmagicStore{storage: storage}
+	return nil
+}
+
+// storageName describes where the variants are stored, for logging purposes.
+func (p *Pixbooster) storageName() string {
+	if store, ok := p.variants.(certmagicStore); ok {
+		return fmt.Sprintf("%T", store.storage)
+	}
+	return p.Storage
+}
+
 func (p Pixbooster) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	p.logger.Debug("Pixbooster start")
 	p.rootURL = p.getRootUrl(r)
-	if p.isOptimizedUrl(r.URL.Path) {
-		optimizedFileName := filepath.Join(p.Storage, p.getOptimizedFileName(r.URL.Path))
-		if data, err := os.ReadFile(optimizedFileName); err == nil {
-			w.Write(data)
-			return nil
-		} else if !os.IsNotExist(err) {
-			p.logger.Error("Unable to access Pixbooster storage")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return err
-		}
-
-		p.logger.Debug("Optimized image URL: " + r.URL.Path)
+	p.pageURL = requestedURL(r)
+	isTransform := p.isTransformRequest(r)
+	// Optimized image URLs are matched in their escaped form only, so that
+	// escaped dots can't make up the suffix.
+	isOptimized := p.isOptimizedUrl(r.URL.EscapedPath())
+	if (isTransform || isOptimized) && len(p.SigningKeys) > 0 && !p.hasValidSignature(r) {
+		p.logger.Debug("Missing or invalid signature: " + r.RequestURI)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil
+	}
+	if isTransform {
+		return p.serveTransform(w, r, next)
+	}
+	if isOptimized {
+		optimizedURL := r.URL.EscapedPath()
+		p.logger.Debug("Optimized image URL: " + optimizedURL)
 		format := imgFormat{}
 		for _, f := range p.destFormats {
-			if strings.HasSuffix(r.URL.Path, f.extension) {
+			if strings.HasSuffix(optimizedURL, f.extension) {
 				format = f
 				break
 			}
@@ -115,92 +386,47 @@ func (p Pixbooster) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 			return nil
 		}
 
-		originalImageUrl := p.getOriginalImageURL(p.rootURL + r.RequestURI)
-		p.logger.Debug("Original image URL: " + originalImageUrl)
-		imgStream, err := p.convertImageToFormat(originalImageUrl, format)
+		width, err := p.getVariantWidth(optimizedURL)
 		if err != nil {
-			p.logger.Error("Error converting image to format: " + format.extension)
-			p.logger.Sugar().Error(err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return err
+			http.Error(w, "Unsupported image width", http.StatusBadRequest)
+			p.logger.Debug(err.Error() + ": " + optimizedURL)
+			return nil
 		}
 
-		w.Header().Set("Content-Type", format.mimeType)
-
-		data, err := io.ReadAll(imgStream)
+		originalURL, err := p.getOriginalImageURL(optimizedURL)
 		if err != nil {
-			p.logger.Error("Error reading image data: " + err.Error())
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			p.logger.Debug(err.Error())
 			return nil
 		}
+		originalURI := p.withQuery(originalURL, r.URL.RawQuery)
+		optimizedPath := p.withQuery(optimizedURL, r.URL.RawQuery)
+		return p.serveOptimizedImage(w, r, next, optimizedPath, originalURI, format, imgTransform{width: width})
+	}
 
-		if _, err := w.Write(data); err != nil {
-			p.logger.Error("Error sending image data: " + err.Error())
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return nil
+	if p.Negotiate && p.isNegotiable(r) {
+		w.Header().Add("Vary", "Accept")
+		if format, ok := p.negotiateFormat(r); ok {
+			p.logger.Debug("Negotiated " + format.mimeType + " for " + r.URL.Path)
+			optimizedURL, err := p.getOptimizedImageURL(r.URL.EscapedPath(), format)
+			if err == nil {
+				optimizedPath := p.withQuery(optimizedURL, r.URL.RawQuery)
+				originalURI := p.withQuery(r.URL.EscapedPath(), r.URL.RawQuery)
+				return p.serveOptimizedImage(w, r, next, optimizedPath, originalURI, format, imgTransform{})
+			}
+			p.logger.Debug("Unable to negotiate " + r.URL.Path + ": " + err.Error())
 		}
-
-		file, err := os.Create(optimizedFileName)
-		if err != nil {
-			return err
+		if next != nil {
+			return next.ServeHTTP(w, r)
 		}
-		defer file.Close()
-
-		_, err = file.Write(data)
-		return err
 	}
 
 	if next != nil {
-		buf := &bytes.Buffer{}
-		rec := caddyhttp.NewResponseRecorder(w, buf, func(s int, h http.Header) bool { return true })
-		err := next.ServeHTTP(rec, r)
-		if err != nil {
-			return err
-		}
-
-		contentType := rec.Header().Get("Content-Type")
-		if strings.HasPrefix(contentType, "text/html") {
-
-			body := buf.Bytes()
-			doc, err := html.Parse(bytes.NewReader(body))
-			if err != nil {
-				return err
-			}
-
-			pictures := p.collectPictures(doc, []*html.Node{})
-			imgs := p.collectImgs(doc, []*html.Node{})
-
-			for _, img := range imgs {
-				p.wrapImgWithPicture(img)
-			}
-
-			for _, picture := range pictures {
-				p.addSourcesToPicture(picture)
-			}
-
-			var result bytes.Buffer
-			if err := html.Render(&result, doc); err != nil {
-				return err
-			}
-
-			for k, vv := range rec.Header() {
-				v := make([]string, len(vv))
-				copy(v, vv)
-				w.Header()[k] = v
-			}
-			delete(rec.Header(), "Content-Length")
-			w.WriteHeader(rec.Status())
-			_, err = io.Copy(w, &result)
-			return err
+		rw := p.newRewriteWriter(w, r)
+		err := next.ServeHTTP(rw, r)
+		if closeErr := rw.close(); err == nil {
+			err = closeErr
 		}
-
-		for k, vv := range rec.Header() {
-			v := make([]string, len(vv))
-			copy(v, vv)
-			w.Header()[k] = v
-		}
-		w.WriteHeader(rec.Status())
-		_, err = io.Copy(w, buf)
 		return err
 	}
 
@@ -208,161 +434,220 @@ func (p Pixbooster) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 	return nil
 }
 
-func (p *Pixbooster) getRootUrl(r *http.Request) string {
-	var proto string
-	if r.TLS == nil {
-		proto = "http://"
-	} else {
-		proto = "https://"
-	}
-	var port string
-	if r.URL.Port() != "" {
-		port = ":" + r.URL.Port()
+// serveOptimizedImage writes the optimized variant identified by optimizedPath,
+// converting the image found at originalURI to format with transform, and
+// storing the result on a cache miss.
+func (p *Pixbooster) serveOptimizedImage(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, optimizedPath string, originalURI string, format imgFormat, transform imgTransform) error {
+	if isWidthOnly(transform) {
+		if width, ok := p.originalWidths.get(p.rootURL + originalURI); ok && transform.width >= width {
+			return p.serveUnresized(w, r, next, originalURI, format)
+		}
 	}
-	return proto + r.Host + port
-}
 
-func (p *Pixbooster) isSameSite(imageURL string) bool {
-	if !strings.HasPrefix(imageURL, "http://") && !strings.HasPrefix(imageURL, "https://") {
-		return true
+	fingerprint, err := p.fingerprintOriginal(r, next, originalURI)
+	if errors.Is(err, errOriginRefused) {
+		p.logger.Warn("Refused to fetch original image", zap.String("host", r.Host), zap.String("uri", originalURI), zap.Error(err))
+		return p.serveUnconverted(w, r, next, originalURI, http.StatusForbidden)
 	}
-
-	imageURLParsed, err := url.Parse(imageURL)
 	if err != nil {
-		p.logger.Sugar().Debug(err)
-		return false
+		p.logger.Debug("Unable to fingerprint original image: " + err.Error())
 	}
 
-	return imageURLParsed.Host == p.rootURL
-}
-
-func (p *Pixbooster) collectImgs(n *html.Node, imgs []*html.Node) []*html.Node {
-	if n.Type == html.ElementNode && n.Data == "img" && p.isSameSite(p.getAttr(n, "src")) && !p.hasAttr(n, "data-pixbooster-ignore") && !p.isImageInsidePicture(n) {
-		src := p.getAttr(n, "src")
-		ext := filepath.Ext(src)
-		mimeType := mime.TypeByExtension(ext)
-		p.logger.Debug(mimeType)
-		for _, format := range p.srcFormats {
-			if format.mimeType == mimeType {
-				imgs = append(imgs, n)
-				break
-			}
+	key := p.getOptimizedFileName(optimizedPath, format, fingerprint)
+	if entry, ok := p.hotCache.get(key); ok {
+		// Keep the stored variant from looking unused to the eviction.
+		p.cacheIndex.touch(key)
+		p.serveVariant(w, r, entry)
+		return nil
+	}
+	if data, modTime, err := p.loadVariant(r.Context(), key); err == nil {
+		p.serveVariant(w, r, p.cacheVariant(key, format, data, modTime))
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		p.logger.Error("Unable to access Pixbooster storage")
+		if p.targetsOriginal(r, next, originalURI) {
+			return next.ServeHTTP(w, r)
 		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return err
 	}
 
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		imgs = p.collectImgs(c, imgs)
+	if p.oversized.has(key) {
+		p.logger.Debug("Original image exceeds the limits, redirect: " + optimizedPath)
+		return p.serveOriginal(w, r, next, originalURI, false)
+	}
+	if p.failures.has(key) {
+		p.logger.Debug("Conversion failed recently, " + p.OnError + ": " + optimizedPath)
+		return p.serveConversionFailure(w, r, next, originalURI)
 	}
-	return imgs
-}
 
-func (p *Pixbooster) collectPictures(n *html.Node, pictures []*html.Node) []*html.Node {
-	if n.Type == html.ElementNode && n.Data == "picture" && !p.hasAttr(n, "data-pixbooster-ignore") {
-		pictures = append(pictures, n)
+	data, shared, err := p.conversions.do(key, time.Duration(p.ConversionWaitTimeout), func() ([]byte, error) {
+		data, err := p.convertAndStore(r, next, originalURI, format, transform, key)
+		if errors.Is(err, errLimitExceeded) {
+			p.oversized.add(key, time.Duration(p.FailureTTL))
+		} else if err != nil && !errors.Is(err, errOriginRefused) && !errors.Is(err, errQueueFull) && !errors.Is(err, errEncoderTimeout) && !errors.Is(err, errWiderThanOriginal) {
+			p.failures.add(key, time.Duration(p.FailureTTL))
+		}
+		return data, err
+	})
+	if shared {
+		p.logger.Debug("Conversion shared with a concurrent request: " + optimizedPath)
 	}
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		pictures = p.collectPictures(c, pictures)
+	if errors.Is(err, errOriginRefused) {
+		p.logger.Warn("Refused to fetch original image", zap.String("host", r.Host), zap.String("uri", originalURI), zap.Error(err))
+		return p.serveUnconverted(w, r, next, originalURI, http.StatusForbidden)
 	}
-	return pictures
-}
-
-func (p *Pixbooster) hasAttr(n *html.Node, name string) bool {
-	for _, attr := range n.Attr {
-		if attr.Key == name {
-			return true
+	if errors.Is(err, errConversionTimeout) {
+		p.logger.Warn("Gave up waiting for a concurrent conversion: " + optimizedPath)
+		return p.serveUnconverted(w, r, next, originalURI, http.StatusServiceUnavailable)
+	}
+	if errors.Is(err, errQueueFull) {
+		p.logger.Warn("Encode queue full, " + p.EncodeQueueFull + ": " + optimizedPath)
+		if p.EncodeQueueFull == queueFullRedirect {
+			return p.serveOriginal(w, r, next, originalURI, false)
 		}
+		return p.serveUnconverted(w, r, next, originalURI, http.StatusServiceUnavailable)
+	}
+	if errors.Is(err, errEncoderTimeout) {
+		p.logger.Warn("Gave up waiting for a free encoder: " + optimizedPath)
+		return p.serveUnconverted(w, r, next, originalURI, http.StatusServiceUnavailable)
+	}
+	if errors.Is(err, errLimitExceeded) {
+		p.logger.Warn("Original image exceeds the limits, redirect", zap.String("uri", originalURI), zap.Error(err))
+		return p.serveOriginal(w, r, next, originalURI, false)
+	}
+	if errors.Is(err, errWiderThanOriginal) {
+		return p.serveUnresized(w, r, next, originalURI, format)
+	}
+	if err != nil {
+		p.logger.Error("Error converting image to format: " + format.extension + ", " + p.OnError)
+		p.logger.Sugar().Error(err)
+		return p.serveConversionFailure(w, r, next, originalURI)
 	}
-	return false
+
+	p.serveVariant(w, r, p.cacheVariant(key, format, data, time.Now()))
+	return nil
 }
 
-func (p *Pixbooster) isImageInsidePicture(img *html.Node) bool {
-	for parent := img.Parent; parent != nil; parent = parent.Parent {
-		if parent.Type == html.ElementNode && parent.Data == "picture" {
-			return true
-		}
+// serveUnresized serves the variant of the original image at its own size,
+// in place of a width it doesn't exceed, which would be an identical encode.
+func (p *Pixbooster) serveUnresized(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, originalURI string, format imgFormat) error {
+	optimizedPath, err := p.getOptimizedImageURL(originalURI, format)
+	if err != nil {
+		p.logger.Debug("Unable to serve unresized image: " + err.Error())
+		return p.serveConversionFailure(w, r, next, originalURI)
 	}
-	return false
+	return p.serveOptimizedImage(w, r, next, optimizedPath, originalURI, format, imgTransform{})
 }
 
-func (p *Pixbooster) getAttr(n *html.Node, attribute string) string {
-	for _, attr := range n.Attr {
-		if attr.Key == attribute {
-			return attr.Val
+// convertAndStore converts the original image found at originalURI to format
+// with transform, and stores the result under key.
+func (p *Pixbooster) convertAndStore(r *http.Request, next caddyhttp.Handler, originalURI string, format imgFormat, transform imgTransform, key string) ([]byte, error) {
+	// Concurrent requests may wait for this conversion, don't abort it if
+	// the client which triggered it goes away.
+	r = r.WithContext(context.WithoutCancel(r.Context()))
+
+	if locker, ok := p.variants.(variantLocker); ok {
+		data, release := p.lockVariant(r.Context(), locker, key)
+		defer release()
+		if data != nil {
+			return data, nil
 		}
 	}
-	return ""
-}
 
-func (p *Pixbooster) wrapImgWithPicture(n *html.Node) {
-	picture := &html.Node{
-		Type: html.ElementNode,
-		Data: "picture",
-	}
-	for _, attr := range n.Attr {
-		if attr.Key != "src" && attr.Key != "alt" && attr.Key != "srcset" {
-			picture.Attr = append(picture.Attr, attr)
-		}
+	p.logger.Debug("Original image URL: " + originalURI)
+	original, err := p.loadOriginal(r, next, originalURI)
+	if err != nil {
+		return nil, err
 	}
 
-	img := &html.Node{
-		Type: html.ElementNode,
-		Data: "img",
-		Attr: n.Attr,
+	config, err := p.checkImageLimits(original.data)
+	if err != nil {
+		return nil, err
+	}
+	p.originalWidths.add(p.rootURL+originalURI, config.Width)
+	if isWidthOnly(transform) && transform.width >= config.Width {
+		return nil, errWiderThanOriginal
 	}
 
-	picture.AppendChild(img)
-	n.Parent.InsertBefore(picture, n)
-	n.Parent.RemoveChild(n)
-	p.addSourcesToPicture(picture)
-}
+	acquireCtx, cancel := context.WithTimeout(r.Context(), time.Duration(p.ConversionWaitTimeout))
+	wait, depth, err := p.encoders.acquire(acquireCtx)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	p.logger.Debug("Encoding "+originalURI+" to "+format.extension, zap.Duration("wait", wait), zap.Int64("queue_depth", depth))
+	// The encoder is released once the conversion ends.
+	imgStream, err := p.convertWithTimeout(original, format, transform)
+	if err != nil {
+		return nil, err
+	}
 
-func (p *Pixbooster) addSourcesToPicture(picture *html.Node) {
-	if picture.Data != "picture" {
-		return
+	data, err := io.ReadAll(imgStream)
+	if err != nil {
+		return nil, err
 	}
 
-	var sources []*html.Node
-	var imgNode *html.Node
+	if err := p.storeVariant(r.Context(), key, data); err != nil {
+		p.logger.Error("Error writing optimized image: " + err.Error())
+	}
+	return data, nil
+}
 
-	for c := picture.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode {
-			if c.Data == "source" {
-				sources = append(sources, c)
-			} else if c.Data == "img" && imgNode == nil {
-				imgNode = c
-			}
-		}
+// cacheVariant prepares the response of an optimized variant along with its
+// caching headers, and keeps it in the in-memory cache.
+func (p *Pixbooster) cacheVariant(key string, format imgFormat, data []byte, modTime time.Time) *hotEntry {
+	header := make(http.Header)
+	header.Set("Content-Type", format.mimeType)
+	header.Set("ETag", `"`+key+`"`)
+	if p.CacheControl != "" {
+		header.Set("Cache-Control", p.CacheControl)
 	}
+	entry := &hotEntry{key: key, header: header, data: data, modTime: modTime}
+	p.hotCache.put(entry)
+	return entry
+}
 
-	if len(sources) == 0 && imgNode != nil {
-		sources = append(sources, imgNode)
+// serveVariant writes an optimized variant. Conditional, HEAD and range
+// requests are handled by http.ServeContent.
+func (p *Pixbooster) serveVariant(w http.ResponseWriter, r *http.Request, entry *hotEntry) {
+	for name, values := range entry.header {
+		w.Header()[name] = values
 	}
+	http.ServeContent(w, r, "", entry.modTime, bytes.NewReader(entry.data))
+}
 
-	for _, source := range sources {
-		p.addSourcesToSource(source)
+func (p *Pixbooster) getRootUrl(r *http.Request) string {
+	var proto string
+	if r.TLS == nil {
+		proto = "http://"
+	} else {
+		proto = "https://"
+	}
+	var port string
+	if r.URL.Port() != "" {
+		port = ":" + r.URL.Port()
 	}
+	return proto + r.Host + port
 }
 
-func (p *Pixbooster) addSourcesToSource(source *html.Node) {
-	if p.hasAttr(source, "srcset") {
-		for _, format := range p.destFormats {
-			if p.isOutputFormatAllowed(format) {
-				p.addSourceNode(source, p.getOptimizedSrcset(p.getAttr(source, "srcset"), format), format.mimeType, source.Data == "source")
-			}
-		}
+func (p *Pixbooster) isSameSite(imageURL string) bool {
+	if !strings.HasPrefix(imageURL, "http://") && !strings.HasPrefix(imageURL, "https://") {
+		return true
 	}
 
-	src := p.getAttr(source, "src")
-	if source.Data == "img" && src != "" && p.isSameSite(src) && p.isInputFormatAllowed(src) {
-		for _, format := range p.destFormats {
-			if p.isOutputFormatAllowed(format) {
-				p.addSourceNode(source, p.getOptimizedImageURL(src, format), format.mimeType, false)
-			}
-		}
+	imageURLParsed, err := url.Parse(imageURL)
+	if err != nil {
+		p.logger.Sugar().Debug(err)
+		return false
 	}
+
+	return imageURLParsed.Host == p.rootURL
 }
 
-func (p *Pixbooster) getOptimizedSrcset(srcset string, format imgFormat) string {
+// getOptimizedSrcset returns srcset with the URLs of the original images
+// replaced by those of their variants in format.
+func (p *Pixbooster) getOptimizedSrcset(srcset string, format imgFormat) (string, error) {
 	srcsetParts := strings.Split(srcset, ",")
 
 	for i, part := range srcsetParts {
@@ -371,58 +656,47 @@ func (p *Pixbooster) getOptimizedSrcset(srcset string, format imgFormat) string
 
 		for j, subPart := range subParts {
 			if p.isInputFormatAllowed(subPart) && p.isSameSite(subPart) {
-				subParts[j] = p.getOptimizedImageURL(subPart, format)
+				optimizedURL, err := p.getOptimizedImageURL(subPart, format)
+				if err != nil {
+					p.logger.Debug("Unable to optimize " + subPart + ": " + err.Error())
+					continue
+				}
+				subParts[j], err = p.signImageURL(optimizedURL)
+				if err != nil {
+					return "", err
+				}
 			}
 		}
 
 		srcsetParts[i] = strings.Join(subParts, " ")
 	}
 
-	return strings.Join(srcsetParts, ",")
+	return strings.Join(srcsetParts, ","), nil
 }
 
-func (p *Pixbooster) addSourceNode(n *html.Node, srcset string, mimeType string, copyAttr bool) {
-	newSource := &html.Node{
-		Type: html.ElementNode,
-		Data: "source",
-		Attr: make([]html.Attribute, 0, len(n.Attr)),
-	}
-
-	if copyAttr {
-		for _, attr := range n.Attr {
-			if attr.Key != "srcset" && attr.Key != "type" && attr.Key != "src" {
-				newSource.Attr = append(newSource.Attr, attr)
-			}
-		}
-	}
-
-	newSource.Attr = append(newSource.Attr, html.Attribute{
-		Key: "srcset",
-		Val: srcset,
-	})
-
-	newSource.Attr = append(newSource.Attr, html.Attribute{
-		Key: "type",
-		Val: mimeType,
-	})
-
-	n.Parent.InsertBefore(newSource, n)
+func (p *Pixbooster) getOptimizedImageURL(originalURL string, format imgFormat) (string, error) {
+	return p.getResizedImageURL(originalURL, format, 0)
 }
 
-func (p *Pixbooster) getOptimizedImageURL(originalURL string, format imgFormat) string {
+// getResizedImageURL returns the URL of the variant of originalURL in format,
+// resized to width if not zero.
+func (p *Pixbooster) getResizedImageURL(originalURL string, format imgFormat, width int) (string, error) {
 	parsedURL, err := url.Parse(originalURL)
 	if err != nil {
-		p.logger.Sugar().Fatalf("Error parsing URL: %v", err)
+		return "", err
 	}
 
 	newPath := parsedURL.Path + "." + p.imgSuffix + format.extension
+	if width > 0 {
+		newPath = parsedURL.Path + "." + p.imgSuffix + ".w" + strconv.Itoa(width) + format.extension
+	}
 
 	parsedURL.Path = newPath
 
-	return parsedURL.String()
+	return parsedURL.String(), nil
 }
 
-func (p *Pixbooster) getOriginalImageURL(optimizedURL string) string {
+func (p *Pixbooster) getOriginalImageURL(optimizedURL string) (string, error) {
 
 	pathParts := strings.Split(optimizedURL, ".")
 	pixboosterIndex := -1
@@ -435,20 +709,16 @@ func (p *Pixbooster) getOriginalImageURL(optimizedURL string) string {
 	}
 
 	if pixboosterIndex == -1 {
-		p.logger.Sugar().Fatalf("Error finding %s suffix in URL: %s", p.imgSuffix, optimizedURL)
+		return "", fmt.Errorf("missing %s suffix in URL: %s", p.imgSuffix, optimizedURL)
 	}
 
-	return strings.Join(pathParts[:pixboosterIndex], ".")
+	return strings.Join(pathParts[:pixboosterIndex], "."), nil
 }
 
+// isOptimizedUrl tells whether the escaped path myurl is the one of an
+// optimized image, like getOriginalImageURL expects it.
 func (p *Pixbooster) isOptimizedUrl(myurl string) bool {
-	parsedURL, err := url.Parse(myurl)
-	if err != nil {
-		p.logger.Sugar().Errorf("Error parsing URL: %v", err)
-		return false
-	}
-
-	pathParts := strings.Split(parsedURL.Path, ".")
+	pathParts := strings.Split(myurl, ".")
 	pixboosterIndex := -1
 
 	for i, part := range pathParts {
@@ -495,17 +765,71 @@ func (p *Pixbooster) isInputFormatAllowed(filename string) bool {
 	}
 }
 
-func (p *Pixbooster) getOptimizedFileName(originalURL string) string {
-	hash := md5.Sum([]byte(originalURL))
+// getOptimizedFileName derives the cache key of a variant from its URL, the
+// encoder options of its format and the fingerprint of the original image, so
+// that changing any of them leads to a new conversion.
+func (p *Pixbooster) getOptimizedFileName(originalURL string, format imgFormat, fingerprint string) string {
+	hash := md5.Sum([]byte(originalURL + "\n" + p.getEncoderOptions(format) + "\n" + fingerprint))
 	return hex.EncodeToString(hash[:])
 }
 
+// getEncoderOptions returns a textual representation of the effective
+// options used to encode format.
+func (p *Pixbooster) getEncoderOptions(format imgFormat) string {
+	switch format.extension {
+	case ".webp":
+		return fmt.Sprintf("%+v", p.WebpConfig)
+	case ".avif":
+		return fmt.Sprintf("%+v", p.AvifConfig)
+	case ".jxl":
+		return fmt.Sprintf("%+v", p.JxlConfig)
+	default:
+		return ""
+	}
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
 //
 //	pixbooster [nowebpoutput|noavif|nojxl|nojpg|nopng] {
 //		[nowebpoutput|noavif|nojxl|nojpg|nopng]
 //		quality <integer between 0 and 100>
 //		storage <directory> Path to the directory where to store generated picture files
+//		storage_backend <module> {
+//			<module options>
+//		}
+//		negotiate
+//		source <root|subrequest|loopback>
+//		root <directory>
+//		trusted_origins <origin...>
+//		allow_private_origins
+//		cache_control <value>
+//		conversion_wait_timeout <duration>
+//		fetch_timeout <duration>
+//		max_concurrent_encodes <integer>
+//		max_encode_queue <integer>
+//		encode_queue_full <unavailable|redirect>
+//		on_error <error|redirect|original>
+//		failure_ttl <duration>
+//		verify_checksums
+//		cache_max_size <size>
+//		cache_ttl <duration>
+//		lock_timeout <duration>
+//		memory_cache_size <size>
+//		rewrite_content_types <types...>
+//		max_page_size <size>
+//		recompress
+//		opt_out_header <header>
+//		widths <widths...>
+//		sizes <sizes>
+//		rewrite_success_only
+//		transform_path [<path>]
+//		transform_query
+//		signing_keys <keys...>
+//		query_policy <keep|ignore|allowlist> [<params...>]
+//		max_input_size <size>
+//		max_pixels <integer>
+//		max_dimension <integer>
+//		conversion_timeout <duration>
 //		webp {
 //			quality <integer between 0 and 100>
 //			lossless
@@ -525,6 +849,29 @@ func (p *Pixbooster) getOptimizedFileName(originalURL string) string {
 // The 'quality' value is inherited by webp.quality, avif.quality, and jxl.quality if not specified.
 // The 'speed' and 'effort' values should be integers between 0 and 10.
 // The 'lossless' and 'exact' flags are set to true if specified.
+// The 'storage_backend' option stores generated picture files in a Caddy storage module instead, like the global 'storage' option.
+// The 'negotiate' flag serves modern formats on the original image URLs according to the Accept header.
+// The 'source' value sets how original images are read, 'root' overrides the site root used by the 'root' source.
+// The 'trusted_origins' and 'allow_private_origins' options restrict the hosts the 'loopback' source may fetch from.
+// The 'cache_control' value is sent as the Cache-Control header of optimized images.
+// The 'conversion_wait_timeout' value bounds the wait for a conversion already running for another request, and for a free encoder.
+// The 'fetch_timeout' value bounds the fetch of an original image or of its fingerprint.
+// The 'max_concurrent_encodes', 'max_encode_queue' and 'encode_queue_full' options control the encoder pool.
+// The 'on_error' value sets how failed conversions are answered, 'failure_ttl' how long they aren't retried.
+// The 'verify_checksums' flag checks stored files against a checksum before serving them.
+// The 'cache_max_size' (e.g. 500MiB) and 'cache_ttl' values bound the storage, evicting the least recently used files.
+// The 'lock_timeout' value bounds the wait for another instance converting the same picture with 'storage_backend'.
+// The 'memory_cache_size' value (e.g. 64MiB) keeps the most recently served pictures in memory.
+// The 'rewrite_content_types' values are rewritten along with text/html pages, other responses are streamed untouched.
+// The 'max_page_size' value (e.g. 5MiB) bounds the size of the rewritten pages.
+// The 'recompress' flag compresses the rewritten pages again with the encoding of the upstream.
+// The 'opt_out_header' value names a response header which leaves a page untouched when set to "off".
+// The 'widths' values (e.g. 320 640 1024 1600) add resized variants to the srcset of the images, along with 'sizes'.
+// The 'transform_path' value (default /_pixbooster) enables the transformation API under that path.
+// The 'transform_query' directive also accepts the transformation options in the query of the images.
+// The 'signing_keys' values sign the optimized image URLs, the first one signs and all of them are accepted.
+// The 'query_policy' value sets which query parameters of the image URLs are part of the cache keys and of the original image requests, 'allowlist' keeps the given ones.
+// The 'max_input_size', 'max_pixels', 'max_dimension' and 'conversion_timeout' values bound the original images, which are served as is when exceeded.
 // All directives are optional.
 func (p *Pixbooster) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	p.Storage = caddy.AppConfigDir() + "/pixbooster"
@@ -555,6 +902,245 @@ func (p *Pixbooster) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			p.Nojpeg = true
 		case "nopng":
 			p.Nopng = true
+		case "negotiate":
+			p.Negotiate = true
+		case "source":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if !isValidSource(d.Val()) {
+				return fmt.Errorf("invalid source value: %s", d.Val())
+			}
+			p.Source = d.Val()
+		case "root":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.Root = d.Val()
+		case "trusted_origins":
+			origins := d.RemainingArgs()
+			if len(origins) == 0 {
+				return d.ArgErr()
+			}
+			for _, origin := range origins {
+				if _, err := normalizeOrigin(origin); err != nil {
+					return fmt.Errorf("invalid trusted origin: %s", origin)
+				}
+			}
+			p.TrustedOrigins = append(p.TrustedOrigins, origins...)
+		case "allow_private_origins":
+			p.AllowPrivateOrigins = true
+		case "cache_control":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			p.CacheControl = strings.Join(args, " ")
+		case "conversion_wait_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid conversion_wait_timeout value: %s", d.Val())
+			}
+			p.ConversionWaitTimeout = caddy.Duration(timeout)
+		case "fetch_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid fetch_timeout value: %s", d.Val())
+			}
+			p.FetchTimeout = caddy.Duration(timeout)
+		case "max_concurrent_encodes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxEncodes, err := strconv.Atoi(d.Val())
+			if err != nil || maxEncodes <= 0 {
+				return fmt.Errorf("invalid max_concurrent_encodes value: %s", d.Val())
+			}
+			p.MaxConcurrentEncodes = maxEncodes
+		case "max_encode_queue":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxQueue, err := strconv.Atoi(d.Val())
+			if err != nil || maxQueue <= 0 {
+				return fmt.Errorf("invalid max_encode_queue value: %s", d.Val())
+			}
+			p.MaxEncodeQueue = maxQueue
+		case "encode_queue_full":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() != queueFullUnavailable && d.Val() != queueFullRedirect {
+				return fmt.Errorf("invalid encode_queue_full value: %s", d.Val())
+			}
+			p.EncodeQueueFull = d.Val()
+		case "on_error":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if !isValidOnError(d.Val()) {
+				return fmt.Errorf("invalid on_error value: %s", d.Val())
+			}
+			p.OnError = d.Val()
+		case "failure_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil || ttl <= 0 {
+				return fmt.Errorf("invalid failure_ttl value: %s", d.Val())
+			}
+			p.FailureTTL = caddy.Duration(ttl)
+		case "verify_checksums":
+			p.VerifyChecksums = true
+		case "cache_max_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 {
+				return fmt.Errorf("invalid cache_max_size value: %s", d.Val())
+			}
+			p.CacheMaxSize = int64(size)
+		case "cache_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil || ttl <= 0 {
+				return fmt.Errorf("invalid cache_ttl value: %s", d.Val())
+			}
+			p.CacheTTL = caddy.Duration(ttl)
+		case "lock_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid lock_timeout value: %s", d.Val())
+			}
+			p.LockTimeout = caddy.Duration(timeout)
+		case "rewrite_content_types":
+			types := d.RemainingArgs()
+			if len(types) == 0 {
+				return d.ArgErr()
+			}
+			for _, contentType := range types {
+				mediaType, _, err := mime.ParseMediaType(contentType)
+				if err != nil {
+					return fmt.Errorf("invalid rewrite_content_types value: %s", contentType)
+				}
+				p.RewriteContentTypes = append(p.RewriteContentTypes, mediaType)
+			}
+		case "widths":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				width, err := strconv.Atoi(arg)
+				if err != nil || width <= 0 {
+					return fmt.Errorf("invalid widths value: %s", arg)
+				}
+				p.Widths = append(p.Widths, width)
+			}
+		case "sizes":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			p.Sizes = strings.Join(args, " ")
+		case "opt_out_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.OptOutHeader = d.Val()
+		case "rewrite_success_only":
+			p.RewriteSuccessOnly = true
+		case "max_input_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 {
+				return fmt.Errorf("invalid max_input_size value: %s", d.Val())
+			}
+			p.MaxInputSize = int64(size)
+		case "max_pixels":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			pixels, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil || pixels <= 0 {
+				return fmt.Errorf("invalid max_pixels value: %s", d.Val())
+			}
+			p.MaxPixels = pixels
+		case "max_dimension":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dimension, err := strconv.Atoi(d.Val())
+			if err != nil || dimension <= 0 {
+				return fmt.Errorf("invalid max_dimension value: %s", d.Val())
+			}
+			p.MaxDimension = dimension
+		case "conversion_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid conversion_timeout value: %s", d.Val())
+			}
+			p.ConversionTimeout = caddy.Duration(timeout)
+		case "query_policy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if !isValidQueryPolicy(d.Val()) {
+				return fmt.Errorf("invalid query_policy value: %s", d.Val())
+			}
+			p.QueryPolicy = d.Val()
+			p.QueryAllowlist = append(p.QueryAllowlist, d.RemainingArgs()...)
+		case "signing_keys":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			p.SigningKeys = append(p.SigningKeys, args...)
+		case "transform_path":
+			p.TransformPath = "/_pixbooster"
+			if d.NextArg() {
+				p.TransformPath = d.Val()
+			}
+		case "transform_query":
+			p.TransformQuery = true
+		case "recompress":
+			p.Recompress = true
+		case "max_page_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 {
+				return fmt.Errorf("invalid max_page_size value: %s", d.Val())
+			}
+			p.MaxPageSize = int64(size)
+		case "memory_cache_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 {
+				return fmt.Errorf("invalid memory_cache_size value: %s", d.Val())
+			}
+			p.MemoryCacheSize = int64(size)
 		case "storage":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -568,6 +1154,19 @@ func (p *Pixbooster) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				p.logger.Error("Configured storage unusable, fallback to default")
 				p.logger.Sugar().Error(err)
 			}
+		case "storage_backend":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "caddy.storage."+name)
+			if err != nil {
+				return err
+			}
+			if _, ok := unm.(caddy.StorageConverter); !ok {
+				return d.Errf("module %s is not a caddy.StorageConverter", name)
+			}
+			p.StorageRaw = caddyconfig.JSONModuleObject(unm, "module", name, nil)
 		case "quality":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -0,0 +1,157 @@
+package pixbooster
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// testJPEG returns a JPEG image of the given size.
+func testJPEG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 100, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// provisionTest provisions p with a temporary storage, JXL and AVIF being
+// disabled to keep the encodes fast. It returns a site root holding a.jpg,
+// and a next handler serving it.
+func provisionTest(t *testing.T, p *Pixbooster) (string, caddyhttp.Handler) {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.jpg"), testJPEG(t, 64, 48), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if p.Storage == "" {
+		p.Storage = t.TempDir()
+	}
+	p.Nojxl = true
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// WebP output is only available with CGO, keep AVIF otherwise.
+	p.Noavif = p.cGOEnabled
+
+	files := http.FileServer(http.Dir(root))
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		files.ServeHTTP(w, r)
+		return nil
+	})
+	return root, next
+}
+
+// testFormat returns the output format enabled by provisionTest.
+func testFormat(p *Pixbooster) imgFormat {
+	for _, format := range p.destFormats {
+		if p.isOutputFormatAllowed(format) {
+			return format
+		}
+	}
+	return imgFormat{}
+}
+
+func serveTest(t *testing.T, p *Pixbooster, next caddyhttp.Handler, method string, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	if err := p.ServeHTTP(w, r, next); err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	return w
+}
+
+func TestNegotiateEscapedPath(t *testing.T) {
+	p := &Pixbooster{Negotiate: true}
+	root, next := provisionTest(t, p)
+	format := testFormat(p)
+	if err := os.WriteFile(filepath.Join(root, "100%.jpg"), testJPEG(t, 16, 16), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveTest(t, p, next, http.MethodGet, "/100%25.jpg", http.Header{"Accept": {format.mimeType}})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != format.mimeType {
+		t.Errorf("got status %d and type %q, want 200 and %q", w.Code, w.Header().Get("Content-Type"), format.mimeType)
+	}
+}
+
+func TestNegotiateFailuresPassThrough(t *testing.T) {
+	p := &Pixbooster{Negotiate: true, OnError: onErrorError}
+	root, next := provisionTest(t, p)
+	accept := http.Header{"Accept": {testFormat(p).mimeType}}
+
+	// Every encoder busy and the queue full.
+	p.encoders = newEncoderPool(1, 1)
+	p.encoders.acquire(context.Background())
+	p.encoders.queued.Store(1)
+	w := serveTest(t, p, next, http.MethodGet, "/a.jpg", accept)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("queue full: got status %d and type %q, want the original image", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	p.encoders = newEncoderPool(1, 1)
+	if err := os.WriteFile(filepath.Join(root, "broken.jpg"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w = serveTest(t, p, next, http.MethodGet, "/broken.jpg", accept)
+	if w.Code != http.StatusOK || w.Body.String() != "not an image" {
+		t.Errorf("conversion failure: got status %d, want the original image", w.Code)
+	}
+}
+
+func TestOptimizedImageURLInvalid(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+	if _, err := p.getOptimizedImageURL("/100%.jpg", testFormat(p)); err == nil {
+		t.Error("expected an error for an invalid URL")
+	}
+	got, err := p.getOptimizedImageURL("/100%25.jpg?v=1", testFormat(p))
+	want := "/100%25.jpg.pixbooster" + testFormat(p).extension + "?v=1"
+	if err != nil || got != want {
+		t.Errorf("got %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestOptimizedURLEscapedDots(t *testing.T) {
+	p := &Pixbooster{}
+	root, next := provisionTest(t, p)
+	format := testFormat(p)
+	if err := os.WriteFile(filepath.Join(root, "100%.jpg"), testJPEG(t, 16, 16), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveTest(t, p, next, http.MethodGet, "/a%2Epixbooster"+format.extension, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("escaped suffix: got status %d, want 404", w.Code)
+	}
+	w = serveTest(t, p, next, http.MethodGet, "/100%25.jpg.pixbooster"+format.extension, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != format.mimeType {
+		t.Errorf("escaped path: got status %d and type %q, want 200 and %q", w.Code, w.Header().Get("Content-Type"), format.mimeType)
+	}
+	if _, err := p.getOriginalImageURL("/a.jpg"); err == nil {
+		t.Error("expected an error for a URL without suffix")
+	}
+}
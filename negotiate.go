@@ -0,0 +1,61 @@
+package pixbooster
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isNegotiable tells if the request targets an original image that may be
+// answered with a modern format variant according to its Accept header.
+func (p *Pixbooster) isNegotiable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return p.isInputFormatAllowed(r.URL.Path)
+}
+
+// negotiateFormat returns the preferred output format explicitly accepted by
+// the client, following the order of destFormats.
+func (p *Pixbooster) negotiateFormat(r *http.Request) (imgFormat, bool) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return imgFormat{}, false
+	}
+	sourceMimeType := mime.TypeByExtension(filepath.Ext(r.URL.Path))
+	for _, format := range p.destFormats {
+		if !p.isOutputFormatAllowed(format) || format.mimeType == sourceMimeType {
+			continue
+		}
+		if acceptsMimeType(accept, format.mimeType) {
+			return format, true
+		}
+	}
+	return imgFormat{}, false
+}
+
+// acceptsMimeType reports if the Accept header value lists mimeType with a
+// non-zero quality. Wildcards such as image/* are ignored on purpose: they
+// don't mean the client is able to decode every image format.
+func acceptsMimeType(accept string, mimeType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mimeType) {
+			continue
+		}
+		for _, param := range params[1:] {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.TrimSpace(key) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || q <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package pixbooster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errOriginRefused is returned when fetching an original image would reach
+// an origin not allowed by the configuration.
+var errOriginRefused = errors.New("origin refused")
+
+// provisionOrigins normalizes the trusted origins and builds the HTTP clients
+// used by the loopback source.
+func (p *Pixbooster) provisionOrigins() error {
+	p.trustedOrigins = make(map[string]bool, len(p.TrustedOrigins))
+	for _, origin := range p.TrustedOrigins {
+		normalized, err := normalizeOrigin(origin)
+		if err != nil {
+			return err
+		}
+		p.trustedOrigins[normalized] = true
+	}
+
+	timeout := time.Duration(p.FetchTimeout)
+	p.trustedClient = &http.Client{
+		CheckRedirect: checkSameOriginRedirect,
+		Timeout:       timeout,
+		Transport:     newOriginTransport(&net.Dialer{Timeout: originDialTimeout}, http.ProxyFromEnvironment, timeout),
+	}
+
+	dialer := &net.Dialer{Timeout: originDialTimeout}
+	if !p.AllowPrivateOrigins {
+		dialer.Control = refusePrivateAddress
+	}
+	// Never through a proxy: the dialer would only check the address of
+	// the proxy, which would reach any host.
+	p.guardedClient = &http.Client{
+		CheckRedirect: checkSameOriginRedirect,
+		Timeout:       timeout,
+		Transport:     newOriginTransport(dialer, nil, timeout),
+	}
+
+	return nil
+}
+
+// Maximum time taken to connect to an origin, and to complete the TLS
+// handshake.
+const originDialTimeout = 10 * time.Second
+
+// newOriginTransport returns a transport connecting with dialer through
+// proxy, waiting at most responseTimeout for the response headers.
+func newOriginTransport(dialer *net.Dialer, proxy func(*http.Request) (*url.URL, error), responseTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   originDialTimeout,
+		ResponseHeaderTimeout: responseTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+	}
+}
+
+// originClient returns the HTTP client allowed to fetch from origin, or an
+// error wrapping errOriginRefused.
+func (p *Pixbooster) originClient(origin string) (*http.Client, error) {
+	normalized, err := normalizeOrigin(origin)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errOriginRefused, err)
+	}
+	if p.trustedOrigins[normalized] {
+		return p.trustedClient, nil
+	}
+	if len(p.trustedOrigins) > 0 {
+		return nil, fmt.Errorf("%w: %s is not a trusted origin", errOriginRefused, normalized)
+	}
+	return p.guardedClient, nil
+}
+
+// normalizeOrigin returns origin as a lowercase scheme://host[:port] string
+// without the default port of the scheme.
+func normalizeOrigin(origin string) (string, error) {
+	parsedURL, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+	scheme := strings.ToLower(parsedURL.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("invalid origin scheme: %s", origin)
+	}
+	if parsedURL.Host == "" {
+		return "", fmt.Errorf("missing origin host: %s", origin)
+	}
+
+	host := strings.ToLower(parsedURL.Hostname())
+	port := parsedURL.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return scheme + "://" + host, nil
+}
+
+// checkSameOriginRedirect refuses to follow redirects leading to another
+// origin than the one of the initial request.
+func checkSameOriginRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	initialOrigin, err := normalizeOrigin(via[0].URL.String())
+	if err != nil {
+		return err
+	}
+	redirectOrigin, err := normalizeOrigin(req.URL.String())
+	if err != nil || redirectOrigin != initialOrigin {
+		return fmt.Errorf("%w: redirect from %s to %s", errOriginRefused, initialOrigin, req.URL.Redacted())
+	}
+	return nil
+}
+
+// refusePrivateAddress is a net.Dialer control function refusing connections
+// to loopback, private, link-local, unspecified and other non-public
+// addresses. It runs after
+// name resolution so it also covers DNS names pointing to such addresses.
+func refusePrivateAddress(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errOriginRefused, err)
+	}
+	if isPrivateAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s is a private address", errOriginRefused, addrPort.Addr())
+	}
+	return nil
+}
+
+// Non-public address ranges not covered by the netip.Addr methods.
+var privatePrefixes = []netip.Prefix{
+	// "This network".
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// Carrier-grade NAT, also used by Tailscale.
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// Benchmarking.
+	netip.MustParsePrefix("198.18.0.0/15"),
+	// NAT64, mapping IPv4 addresses, private ones included.
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+func isPrivateAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range privatePrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package pixbooster
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeOrigin(t *testing.T) {
+	tests := map[string]string{
+		"http://Example.COM":       "http://example.com",
+		"https://example.com:443/": "https://example.com",
+		"http://example.com:8080":  "http://example.com:8080",
+		"http://[::1]:80":          "http://[::1]",
+		"https://[::1]:8443":       "https://[::1]:8443",
+	}
+	for origin, want := range tests {
+		if got, err := normalizeOrigin(origin); err != nil || got != want {
+			t.Errorf("normalizeOrigin(%q) = %q, %v, want %q", origin, got, err, want)
+		}
+	}
+	for _, origin := range []string{"ftp://example.com", "example.com", "http://", "/photos"} {
+		if _, err := normalizeOrigin(origin); err == nil {
+			t.Errorf("normalizeOrigin(%q) succeeded, want an error", origin)
+		}
+	}
+}
+
+func TestOriginClient(t *testing.T) {
+	p := &Pixbooster{TrustedOrigins: []string{"https://example.com"}}
+	if err := p.provisionOrigins(); err != nil {
+		t.Fatal(err)
+	}
+	if client, err := p.originClient("https://EXAMPLE.com:443"); err != nil || client != p.trustedClient {
+		t.Errorf("trusted origin: got %v, want the trusted client", err)
+	}
+	if _, err := p.originClient("http://example.com"); !errors.Is(err, errOriginRefused) {
+		t.Errorf("untrusted origin: got %v, want errOriginRefused", err)
+	}
+	if _, err := p.originClient("gopher://example.com"); !errors.Is(err, errOriginRefused) {
+		t.Errorf("invalid origin: got %v, want errOriginRefused", err)
+	}
+
+	p = &Pixbooster{}
+	if err := p.provisionOrigins(); err != nil {
+		t.Fatal(err)
+	}
+	if client, err := p.originClient("http://example.com"); err != nil || client != p.guardedClient {
+		t.Errorf("without trusted origins: got %v, want the guarded client", err)
+	}
+	if transport, ok := p.guardedClient.Transport.(*http.Transport); !ok || transport.Proxy != nil {
+		t.Error("the guarded client must not go through a proxy")
+	}
+}
+
+func TestRefusePrivateAddress(t *testing.T) {
+	for address, refused := range map[string]bool{
+		"127.0.0.1:80":          true,
+		"10.1.2.3:443":          true,
+		"192.168.0.1:80":        true,
+		"169.254.169.254:80":    true,
+		"0.0.0.0:80":            true,
+		"[::1]:80":              true,
+		"[fe80::1]:80":          true,
+		"[::ffff:127.0.0.1]:80": true,
+		"0.1.2.3:80":            true,
+		"100.64.0.1:80":         true,
+		"100.127.255.254:80":    true,
+		"198.18.0.1:80":         true,
+		"198.19.255.254:80":     true,
+		"[64:ff9b::a00:1]:80":   true,
+		"100.128.0.1:80":        false,
+		"93.184.216.34:443":     false,
+		"[2606:4700::1]:443":    false,
+	} {
+		err := refusePrivateAddress("tcp", address, nil)
+		if refused != errors.Is(err, errOriginRefused) {
+			t.Errorf("refusePrivateAddress(%q) = %v, want refused: %v", address, err, refused)
+		}
+	}
+	if isPrivateAddress(netip.MustParseAddr("8.8.8.8")) {
+		t.Error("8.8.8.8 is a public address")
+	}
+}
+
+func TestGuardedClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	p := &Pixbooster{}
+	if err := p.provisionOrigins(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := p.originClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(server.URL); !errors.Is(err, errOriginRefused) {
+		t.Errorf("got %v, want errOriginRefused", err)
+	}
+
+	p = &Pixbooster{AllowPrivateOrigins: true}
+	if err := p.provisionOrigins(); err != nil {
+		t.Fatal(err)
+	}
+	client, _ = p.originClient(server.URL)
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("with allow_private_origins: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestCheckSameOriginRedirect(t *testing.T) {
+	request := func(rawURL string) *http.Request {
+		parsedURL, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Request{URL: parsedURL}
+	}
+	via := []*http.Request{request("https://example.com/a.jpg")}
+	if err := checkSameOriginRedirect(request("https://example.com:443/b.jpg"), via); err != nil {
+		t.Errorf("same origin redirect refused: %v", err)
+	}
+	for _, target := range []string{"http://example.com/b.jpg", "https://evil.example/b.jpg", "https://127.0.0.1/b.jpg"} {
+		if err := checkSameOriginRedirect(request(target), via); !errors.Is(err, errOriginRefused) {
+			t.Errorf("redirect to %s: got %v, want errOriginRefused", target, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package pixbooster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Behaviors when the encoder queue is full.
+const (
+	// Answer with a 503 Service Unavailable and a Retry-After header.
+	queueFullUnavailable = "unavailable"
+	// Send the client to the original image.
+	queueFullRedirect = "redirect"
+)
+
+// errQueueFull is returned when an encode can't even wait for a free encoder.
+var errQueueFull = errors.New("encoder queue full")
+
+// errEncoderTimeout is returned when an encode gave up waiting for a free
+// encoder, as they may all be held by conversions given up but still running.
+var errEncoderTimeout = errors.New("timed out waiting for a free encoder")
+
+var poolMetrics = struct {
+	init       sync.Once
+	inProgress prometheus.Gauge
+	queueDepth prometheus.Gauge
+	waitTime   prometheus.Histogram
+	rejected   prometheus.Counter
+}{}
+
+func initPoolMetrics() {
+	const ns, sub = "caddy", "pixbooster"
+
+	poolMetrics.inProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "encodes_in_progress",
+		Help:      "Number of images currently being encoded.",
+	})
+	poolMetrics.queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "encode_queue_depth",
+		Help:      "Number of encodes waiting for a free encoder.",
+	})
+	poolMetrics.waitTime = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "encode_wait_seconds",
+		Help:      "Histogram of the time spent waiting for a free encoder.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	poolMetrics.rejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "encodes_rejected_total",
+		Help:      "Number of encodes rejected because the queue was full.",
+	})
+}
+
+// encoderPool bounds the number of concurrent encodes and of encodes waiting
+// for a free encoder.
+type encoderPool struct {
+	slots    chan struct{}
+	maxQueue int64
+	queued   atomic.Int64
+}
+
+func newEncoderPool(maxEncodes int, maxQueue int) *encoderPool {
+	poolMetrics.init.Do(initPoolMetrics)
+	return &encoderPool{
+		slots:    make(chan struct{}, maxEncodes),
+		maxQueue: int64(maxQueue),
+	}
+}
+
+// acquire waits for a free encoder until ctx is done, unless too many encodes
+// are already waiting. It returns the time spent waiting and the queue depth
+// seen.
+func (e *encoderPool) acquire(ctx context.Context) (time.Duration, int64, error) {
+	select {
+	case e.slots <- struct{}{}:
+		poolMetrics.inProgress.Inc()
+		poolMetrics.waitTime.Observe(0)
+		return 0, 0, nil
+	default:
+	}
+
+	depth := e.queued.Add(1)
+	if depth > e.maxQueue {
+		e.queued.Add(-1)
+		poolMetrics.rejected.Inc()
+		return 0, depth - 1, errQueueFull
+	}
+	poolMetrics.queueDepth.Inc()
+
+	start := time.Now()
+	select {
+	case e.slots <- struct{}{}:
+	case <-ctx.Done():
+		e.queued.Add(-1)
+		poolMetrics.queueDepth.Dec()
+		poolMetrics.rejected.Inc()
+		return time.Since(start), depth, fmt.Errorf("%w: %v", errEncoderTimeout, ctx.Err())
+	}
+	wait := time.Since(start)
+
+	e.queued.Add(-1)
+	poolMetrics.queueDepth.Dec()
+	poolMetrics.inProgress.Inc()
+	poolMetrics.waitTime.Observe(wait.Seconds())
+	return wait, depth, nil
+}
+
+func (e *encoderPool) release() {
+	poolMetrics.inProgress.Dec()
+	<-e.slots
+}
@@ -0,0 +1,41 @@
+package pixbooster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEncoderPoolAcquire(t *testing.T) {
+	e := newEncoderPool(1, 1)
+	if _, _, err := e.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The only encoder is held, a second encode waits in the queue.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, _, err := e.acquire(ctx)
+		done <- err
+	}()
+	for e.queued.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, err := e.acquire(context.Background()); !errors.Is(err, errQueueFull) {
+		t.Errorf("got %v with the queue full, want errQueueFull", err)
+	}
+	if err := <-done; !errors.Is(err, errEncoderTimeout) {
+		t.Errorf("got %v, want errEncoderTimeout", err)
+	}
+	if e.queued.Load() != 0 {
+		t.Errorf("%d encodes still queued", e.queued.Load())
+	}
+
+	e.release()
+	if _, _, err := e.acquire(context.Background()); err != nil {
+		t.Errorf("got %v once released", err)
+	}
+}
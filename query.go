@@ -0,0 +1,63 @@
+package pixbooster
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Policies for the query strings of the image URLs.
+const (
+	// Keep every query parameter.
+	queryKeep = "keep"
+	// Drop every query parameter.
+	queryIgnore = "ignore"
+	// Keep the parameters listed in QueryAllowlist only.
+	queryAllowlist = "allowlist"
+)
+
+func isValidQueryPolicy(policy string) bool {
+	switch policy {
+	case queryKeep, queryIgnore, queryAllowlist:
+		return true
+	default:
+		return false
+	}
+}
+
+// filterQuery returns the parameters of rawQuery kept by the query policy,
+// in their original order and encoding. The signature is never kept, nor are
+// the parameters named in excluded.
+func (p *Pixbooster) filterQuery(rawQuery string, excluded ...string) string {
+	if p.QueryPolicy == queryIgnore || rawQuery == "" {
+		return ""
+	}
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if name == signatureParam || slices.Contains(excluded, name) {
+			continue
+		}
+		if p.QueryPolicy == queryAllowlist && !slices.Contains(p.QueryAllowlist, name) {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
+
+// withQuery returns path followed by the parameters of rawQuery kept by the
+// query policy. It is used both for the cache keys and to fetch the original
+// images, so that they always match.
+func (p *Pixbooster) withQuery(path string, rawQuery string, excluded ...string) string {
+	if query := p.filterQuery(rawQuery, excluded...); query != "" {
+		return path + "?" + query
+	}
+	return path
+}
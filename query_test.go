@@ -0,0 +1,66 @@
+package pixbooster
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestFilterQuery(t *testing.T) {
+	tests := []struct {
+		policy    string
+		allowlist []string
+		rawQuery  string
+		excluded  []string
+		want      string
+	}{
+		{queryKeep, nil, "", nil, ""},
+		{queryKeep, nil, "v=1&utm_source=x", nil, "v=1&utm_source=x"},
+		{queryKeep, nil, "v=1&&b=%20c", nil, "v=1&b=%20c"},
+		{queryKeep, nil, "v=1&sig=abc", nil, "v=1"},
+		{queryKeep, nil, "s%69g=abc&v=1", nil, "v=1"},
+		{queryIgnore, nil, "v=1&utm_source=x", nil, ""},
+		{queryAllowlist, []string{"v"}, "utm_source=x&v=1&v=2", nil, "v=1&v=2"},
+		{queryAllowlist, []string{"v"}, "%76=1&w=2", nil, "%76=1"},
+		{queryAllowlist, []string{"v", "sig"}, "v=1&sig=abc", nil, "v=1"},
+		{queryKeep, nil, "w=800&v=1&f=avif&h=600", transformKeys, "v=1"},
+	}
+	for _, test := range tests {
+		p := &Pixbooster{QueryPolicy: test.policy, QueryAllowlist: test.allowlist}
+		if got := p.filterQuery(test.rawQuery, test.excluded...); got != test.want {
+			t.Errorf("%s %v: filterQuery(%q) = %q, want %q", test.policy, test.allowlist, test.rawQuery, got, test.want)
+		}
+	}
+
+	p := &Pixbooster{QueryPolicy: queryIgnore}
+	if got := p.withQuery("/a.jpg", "v=1"); got != "/a.jpg" {
+		t.Errorf("withQuery = %q, want /a.jpg", got)
+	}
+}
+
+func TestQueryPolicyKeys(t *testing.T) {
+	p := &Pixbooster{QueryPolicy: queryAllowlist, QueryAllowlist: []string{"v"}}
+	_, original := provisionTest(t, p)
+	format := testFormat(p)
+
+	var fetched []string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method == http.MethodGet {
+			fetched = append(fetched, r.URL.RequestURI())
+		}
+		return original.ServeHTTP(w, r)
+	})
+
+	for _, query := range []string{"?v=1&utm_source=x", "?utm_source=y&v=1"} {
+		w := serveTest(t, p, next, http.MethodGet, "/a.jpg.pixbooster"+format.extension+query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", query, w.Code)
+		}
+	}
+	// The second request shares the cache key of the first one, which
+	// matches the original image fetched.
+	if len(fetched) != 1 || fetched[0] != "/a.jpg?v=1" {
+		t.Errorf("fetched %v, want [/a.jpg?v=1]", fetched)
+	}
+}
@@ -0,0 +1,240 @@
+package pixbooster
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// getVariantWidth returns the width carried by an optimized image URL, as in
+// photo.jpg.pixbooster.w640.avif, or 0 if it carries none. Only the
+// configured widths are accepted.
+func (p *Pixbooster) getVariantWidth(optimizedURL string) (int, error) {
+	pathParts := strings.Split(optimizedURL, ".")
+	pixboosterIndex := slices.Index(pathParts, p.imgSuffix)
+	// The suffix is followed by the extension, or the width and the
+	// extension.
+	if pixboosterIndex == -1 || len(pathParts)-pixboosterIndex != 3 {
+		return 0, nil
+	}
+
+	widthPart := pathParts[pixboosterIndex+1]
+	width, err := strconv.Atoi(strings.TrimPrefix(widthPart, "w"))
+	if !strings.HasPrefix(widthPart, "w") || err != nil || !slices.Contains(p.Widths, width) {
+		return 0, fmt.Errorf("unsupported image width: %s", widthPart)
+	}
+	return width, nil
+}
+
+// getResponsiveSrcset returns a srcset listing the variants of originalURL
+// in format at each configured width. Once the width of the original image
+// is known, the widths it doesn't exceed are replaced by the variant at its
+// own size.
+func (p *Pixbooster) getResponsiveSrcset(originalURL string, format imgFormat) (string, error) {
+	originalWidth, known := p.originalWidth(originalURL)
+	candidates := make([]string, 0, len(p.Widths))
+	unresized := false
+	for _, width := range p.Widths {
+		if known && width >= originalWidth {
+			unresized = true
+			continue
+		}
+		resizedURL, err := p.getResizedImageURL(originalURL, format, width)
+		if err != nil {
+			return "", err
+		}
+		signedURL, err := p.signImageURL(resizedURL)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, signedURL+" "+strconv.Itoa(width)+"w")
+	}
+	if unresized {
+		optimizedURL, err := p.getOptimizedImageURL(originalURL, format)
+		if err != nil {
+			return "", err
+		}
+		signedURL, err := p.signImageURL(optimizedURL)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, signedURL+" "+strconv.Itoa(originalWidth)+"w")
+	}
+	return strings.Join(candidates, ", "), nil
+}
+
+// Number of original image widths remembered, beyond which they are all
+// forgotten.
+const maxKnownWidths = 10000
+
+// errWiderThanOriginal is returned when an image would be resized to a width
+// it doesn't exceed, giving the same image as its unresized variant.
+var errWiderThanOriginal = errors.New("width not smaller than the original image")
+
+// widthCache remembers the width of the original images met by the
+// conversions, so that the variants they can't be resized to are neither
+// listed nor encoded.
+type widthCache struct {
+	mu      sync.Mutex
+	entries map[string]int
+}
+
+func newWidthCache() *widthCache {
+	return &widthCache{entries: make(map[string]int)}
+}
+
+func (c *widthCache) add(key string, width int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxKnownWidths {
+		clear(c.entries)
+	}
+	c.entries[key] = width
+}
+
+func (c *widthCache) get(key string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	width, ok := c.entries[key]
+	return width, ok
+}
+
+// originalWidth returns the width of the original image at originalURL, as
+// found by a previous conversion. URLs are resolved against the base of the
+// page being rewritten.
+func (p *Pixbooster) originalWidth(originalURL string) (int, bool) {
+	parsedURL, err := p.resolveImageURL(originalURL)
+	if err != nil {
+		return 0, false
+	}
+	if parsedURL.Host != "" && parsedURL.Scheme+"://"+parsedURL.Host != p.rootURL {
+		return 0, false
+	}
+	return p.originalWidths.get(p.rootURL + p.withQuery(parsedURL.EscapedPath(), parsedURL.RawQuery))
+}
+
+// isWidthOnly tells whether t resizes the image to a width, and does
+// nothing else.
+func isWidthOnly(t imgTransform) bool {
+	return t.width > 0 && t.height == 0 && t.quality == 0
+}
+
+// Fit modes of an image resized to both a width and a height.
+const (
+	// Fit within the box, padding it to its size.
+	fitContain = "contain"
+	// Cover the box, cropping what overflows.
+	fitCover = "cover"
+	// Stretch to the box, ignoring the aspect ratio.
+	fitFill = "fill"
+	// Fit within the box.
+	fitInside = "inside"
+)
+
+// Anchors of the image within the box, when cropped or padded. Each gravity
+// maps to its horizontal and vertical position, from 0 (left or top) to 1
+// (right or bottom).
+var gravities = map[string][2]float64{
+	"center":    {0.5, 0.5},
+	"north":     {0.5, 0},
+	"south":     {0.5, 1},
+	"east":      {1, 0.5},
+	"west":      {0, 0.5},
+	"northeast": {1, 0},
+	"northwest": {0, 0},
+	"southeast": {1, 1},
+	"southwest": {0, 1},
+}
+
+// imgTransform describes how an image is transformed before being encoded.
+// Zero values keep the image as is.
+type imgTransform struct {
+	width   int
+	height  int
+	fit     string
+	gravity string
+	quality int
+}
+
+// transformImage resizes img as described by t. Images are never upscaled:
+// a box larger than the image is shrunk to fit in it, keeping its aspect
+// ratio.
+func transformImage(img image.Image, t imgTransform) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	width, height := t.width, t.height
+	switch {
+	case width == 0 && height == 0:
+		return img
+	case height == 0:
+		height = scaleDimension(srcHeight, width, srcWidth)
+	case width == 0:
+		width = scaleDimension(srcWidth, height, srcHeight)
+	}
+
+	if width > srcWidth || height > srcHeight {
+		ratio := min(float64(srcWidth)/float64(width), float64(srcHeight)/float64(height))
+		width = max(1, int(math.Round(float64(width)*ratio)))
+		height = max(1, int(math.Round(float64(height)*ratio)))
+	}
+	if width == srcWidth && height == srcHeight {
+		return img
+	}
+
+	anchor, ok := gravities[t.gravity]
+	if !ok {
+		anchor = gravities["center"]
+	}
+
+	switch {
+	case t.width == 0 || t.height == 0 || t.fit == fitFill:
+		return scaleImage(img, bounds, width, height)
+	case t.fit == fitCover:
+		scale := max(float64(width)/float64(srcWidth), float64(height)/float64(srcHeight))
+		crop := image.Rect(0, 0, min(srcWidth, int(math.Round(float64(width)/scale))), min(srcHeight, int(math.Round(float64(height)/scale))))
+		crop = crop.Add(bounds.Min).Add(anchorOffset(bounds.Size(), crop.Size(), anchor))
+		return scaleImage(img, crop, width, height)
+	default:
+		scale := min(float64(width)/float64(srcWidth), float64(height)/float64(srcHeight))
+		innerWidth := max(1, int(math.Round(float64(srcWidth)*scale)))
+		innerHeight := max(1, int(math.Round(float64(srcHeight)*scale)))
+		if t.fit == fitInside {
+			return scaleImage(img, bounds, innerWidth, innerHeight)
+		}
+		// Pad with transparent pixels.
+		padded := image.NewRGBA(image.Rect(0, 0, width, height))
+		inner := image.Rect(0, 0, innerWidth, innerHeight)
+		inner = inner.Add(anchorOffset(padded.Bounds().Size(), inner.Size(), anchor))
+		draw.CatmullRom.Scale(padded, inner, img, bounds, draw.Src, nil)
+		return padded
+	}
+}
+
+// scaleDimension returns dimension scaled by target/reference, at least 1.
+func scaleDimension(dimension int, target int, reference int) int {
+	return max(1, int(math.Round(float64(dimension)*float64(target)/float64(reference))))
+}
+
+// scaleImage scales the src part of img to width and height, with a
+// Catmull-Rom filter.
+func scaleImage(img image.Image, src image.Rectangle, width int, height int) image.Image {
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, src, draw.Src, nil)
+	return scaled
+}
+
+// anchorOffset returns the position of a box of size inner within a box of
+// size outer, placed at anchor.
+func anchorOffset(outer image.Point, inner image.Point, anchor [2]float64) image.Point {
+	return image.Pt(
+		int(math.Round(float64(outer.X-inner.X)*anchor[0])),
+		int(math.Round(float64(outer.Y-inner.Y)*anchor[1])),
+	)
+}
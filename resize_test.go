@@ -0,0 +1,34 @@
+package pixbooster
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestWiderThanOriginal(t *testing.T) {
+	p := &Pixbooster{Widths: []int{32, 1024}}
+	_, next := provisionTest(t, p)
+	format := testFormat(p)
+
+	wide := serveTest(t, p, next, http.MethodGet, "/a.jpg.pixbooster.w1024"+format.extension, nil)
+	unresized := serveTest(t, p, next, http.MethodGet, "/a.jpg.pixbooster"+format.extension, nil)
+	if wide.Code != http.StatusOK || unresized.Code != http.StatusOK {
+		t.Fatalf("got status %d and %d, want 200", wide.Code, unresized.Code)
+	}
+	if !bytes.Equal(wide.Body.Bytes(), unresized.Body.Bytes()) {
+		t.Error("a width larger than the original image didn't get the unresized variant")
+	}
+
+	p.rootURL = "http://example.com"
+	got, err := p.getResponsiveSrcset("/a.jpg", format)
+	want := "/a.jpg.pixbooster.w32" + format.extension + " 32w, /a.jpg.pixbooster" + format.extension + " 64w"
+	if err != nil || got != want {
+		t.Errorf("got srcset %q, %v, want %q", got, err, want)
+	}
+	got, _ = p.getResponsiveSrcset("/unknown.jpg", format)
+	want = "/unknown.jpg.pixbooster.w32" + format.extension + " 32w, /unknown.jpg.pixbooster.w1024" + format.extension + " 1024w"
+	if got != want {
+		t.Errorf("got srcset %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,781 @@
+package pixbooster
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding"
+)
+
+// Largest <picture> element held back to be rewritten, in bytes. Larger ones
+// are passed through untouched.
+const maxHeldPicture = 64 << 10
+
+// Largest start of a page held back while looking for an opt-out <meta>
+// element, in bytes. The page is rewritten beyond it.
+const maxHeldHead = 64 << 10
+
+// shouldRewrite tells from the response headers whether the response is a
+// page to rewrite. Anything else streams through untouched, including byte
+// ranges of pages, which can't be rewritten without breaking Content-Range.
+func (p *Pixbooster) shouldRewrite(status int, header http.Header) bool {
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if !p.isRewrittenType(mediaType) {
+		return false
+	}
+	if p.RewriteSuccessOnly && (status < 200 || status > 299) {
+		p.logger.Debug("Page status isn't 2xx, not rewriting it", zap.Int("status", status))
+		return false
+	}
+	if hasNoTransform(header) {
+		p.logger.Debug("Page marked no-transform, not rewriting it")
+		return false
+	}
+	if p.OptOutHeader != "" && strings.EqualFold(strings.TrimSpace(header.Get(p.OptOutHeader)), "off") {
+		p.logger.Debug("Page opted out with the " + p.OptOutHeader + " header, not rewriting it")
+		return false
+	}
+	if encoding := contentEncoding(header); encoding != "" && !isSupportedEncoding(encoding) {
+		p.logger.Debug("Unsupported page encoding, not rewriting it", zap.String("encoding", encoding))
+		return false
+	}
+	if p.MaxPageSize > 0 {
+		length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if err == nil && length > p.MaxPageSize {
+			p.logger.Debug("Page larger than max_page_size, not rewriting it", zap.Int64("size", length))
+			return false
+		}
+	}
+	return true
+}
+
+func hasNoTransform(header http.Header) bool {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Pixbooster) isRewrittenType(mediaType string) bool {
+	if mediaType == "text/html" {
+		return true
+	}
+	for _, contentType := range p.RewriteContentTypes {
+		if strings.EqualFold(mediaType, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteWriter passes the body of the pages to rewrite to rewriteHTML,
+// running in its own goroutine so that a page is rewritten while it is being
+// generated. Other responses are written straight to the client.
+type rewriteWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	p *Pixbooster
+	// Responses to HEAD requests get the headers of the rewritten pages,
+	// but have no body to rewrite.
+	head bool
+	// Path of the request, telling what a 304 response stands for.
+	path        string
+	wroteHeader bool
+	// Body chunks for the rewriter, a nil chunk asks for a flush.
+	chunks  chan []byte
+	stopped chan struct{}
+	err     error
+}
+
+func (p *Pixbooster) newRewriteWriter(w http.ResponseWriter, r *http.Request) *rewriteWriter {
+	return &rewriteWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		p:                     p,
+		head:                  r.Method == http.MethodHead,
+		path:                  r.URL.Path,
+	}
+}
+
+func (rw *rewriteWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	// Informational responses aren't final, just pass them.
+	if 100 <= status && status <= 199 {
+		rw.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	rw.wroteHeader = true
+
+	rewrite := rw.p.shouldRewrite(status, rw.Header())
+	// The entity tag of a page revalidated must match the one sent along
+	// with its rewritten version.
+	if status == http.StatusNotModified && rw.isRewrittenPage() {
+		weakenETag(rw.Header())
+	}
+	if rw.p.OptOutHeader != "" {
+		rw.Header().Del(rw.p.OptOutHeader)
+	}
+	if !rewrite {
+		rw.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+
+	encoding := contentEncoding(rw.Header())
+	if encoding != "" && !rw.p.Recompress {
+		rw.Header().Del("Content-Encoding")
+	}
+	rw.Header().Del("Content-Length")
+	weakenETag(rw.Header())
+	rw.ResponseWriterWrapper.WriteHeader(status)
+	if rw.head {
+		return
+	}
+	// Send the headers now, so that the rewriter goroutine only writes the
+	// body.
+	http.NewResponseController(rw.ResponseWriter).Flush()
+
+	contentType := rw.Header().Get("Content-Type")
+	rw.chunks = make(chan []byte)
+	rw.stopped = make(chan struct{})
+	go func() {
+		defer close(rw.stopped)
+		rw.err = rw.rewrite(encoding, contentType)
+	}()
+}
+
+// isRewrittenPage tells whether a 304 response stands for a page which is
+// rewritten. Its Content-Type is usually left out, the extension of the path
+// is used instead, a path without any being taken as a page.
+func (rw *rewriteWriter) isRewrittenPage() bool {
+	header := rw.Header().Clone()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/html")
+		if ext := path.Ext(rw.path); ext != "" {
+			header.Set("Content-Type", mime.TypeByExtension(ext))
+		}
+	}
+	return rw.p.shouldRewrite(http.StatusOK, header)
+}
+
+// rewrite rewrites the body sent through chunks, decompressing it first if
+// encoded, and compressing it again if configured.
+func (rw *rewriteWriter) rewrite(encoding string, contentType string) error {
+	reader := &chunkReader{chunks: rw.chunks}
+	var dst io.Writer = rw.ResponseWriter
+	reader.flush = func() {
+		http.NewResponseController(rw.ResponseWriter).Flush()
+	}
+	// An empty body isn't even a valid compressed stream, there is nothing
+	// to rewrite.
+	src := bufio.NewReader(reader)
+	if _, err := src.Peek(1); err == io.EOF {
+		return nil
+	}
+	if encoding == "" {
+		return rw.p.rewriteEncodedHTML(dst, src, contentType)
+	}
+
+	decoder, err := newDecoder(encoding, src)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+	if !rw.p.Recompress {
+		return rw.p.rewriteEncodedHTML(dst, decoder, contentType)
+	}
+
+	encoder, err := newEncoder(encoding, dst)
+	if err != nil {
+		return err
+	}
+	reader.flush = func() {
+		encoder.Flush()
+		http.NewResponseController(rw.ResponseWriter).Flush()
+	}
+	if err := rw.p.rewriteEncodedHTML(encoder, decoder, contentType); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+func (rw *rewriteWriter) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	if rw.chunks == nil {
+		return rw.ResponseWriterWrapper.Write(data)
+	}
+
+	// The caller may reuse data as soon as Write returns.
+	chunk := make([]byte, len(data))
+	copy(chunk, data)
+	select {
+	case rw.chunks <- chunk:
+		return len(data), nil
+	case <-rw.stopped:
+		if rw.err != nil {
+			return 0, rw.err
+		}
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (rw *rewriteWriter) ReadFrom(r io.Reader) (int64, error) {
+	rw.WriteHeader(http.StatusOK)
+	if rw.chunks == nil {
+		return rw.ResponseWriterWrapper.ReadFrom(r)
+	}
+	// Hide ReadFrom from io.Copy, which would call it again.
+	return io.Copy(struct{ io.Writer }{rw}, r)
+}
+
+// FlushError flushes what the rewriter has written so far. The content of
+// the element being held back is only written once complete.
+func (rw *rewriteWriter) FlushError() error {
+	rw.WriteHeader(http.StatusOK)
+	if rw.chunks == nil {
+		return http.NewResponseController(rw.ResponseWriter).Flush()
+	}
+	select {
+	case rw.chunks <- nil:
+	case <-rw.stopped:
+	}
+	return nil
+}
+
+func (rw *rewriteWriter) Flush() {
+	rw.FlushError()
+}
+
+// close waits for the rewriter to write the whole page.
+func (rw *rewriteWriter) close() error {
+	if rw.chunks == nil {
+		return nil
+	}
+	close(rw.chunks)
+	<-rw.stopped
+	return rw.err
+}
+
+// chunkReader reads the chunks sent by rewriteWriter.
+type chunkReader struct {
+	chunks  <-chan []byte
+	pending []byte
+	flush   func()
+}
+
+func (c *chunkReader) Read(data []byte) (int, error) {
+	for len(c.pending) == 0 {
+		chunk, ok := <-c.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		if chunk == nil {
+			// Everything read so far has been processed.
+			c.flush()
+			continue
+		}
+		c.pending = chunk
+	}
+	n := copy(data, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// rewriteHTML copies the page read from r to w, adding the optimized sources
+// of its images. Tokens are written as soon as they are read, except for the
+// content of <picture> elements, held back until they are closed.
+//
+// Unlike a parser, the tokenizer doesn't complete the markup with the
+// missing <html>, <head> and <body> elements, so HTML fragments (e.g. htmx
+// or Turbo partial responses) come out as fragments, without any detection.
+//
+// The start of the page is held back until the end of its <head> or its
+// first image, so that the whole page is left alone if it opts out with a
+// <meta> element.
+//
+// Relative image URLs resolve against the <base> of the page, or the page
+// URL once the page turns out to be a whole document. In fragments, which
+// end up in a document of unknown URL, they can't be resolved, so they
+// can't be signed.
+//
+// Pages in another ASCII-compatible encoding than UTF-8 are given with enc:
+// they are tokenized as is, only the tags to rewrite are decoded, and the
+// added ones encoded.
+func (p *Pixbooster) rewriteHTML(w io.Writer, r io.Reader, enc encoding.Encoding) error {
+	rewriter := &htmlRewriter{p: p, w: w, enc: enc, head: []byte{}}
+	z := html.NewTokenizer(r)
+	var size int64
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return err
+			}
+			if err := rewriter.writeHead(); err != nil {
+				return err
+			}
+			return rewriter.writePicture()
+		}
+
+		raw := z.Raw()
+		size += int64(len(raw))
+		if p.MaxPageSize > 0 && size > p.MaxPageSize {
+			p.logger.Debug("Page larger than max_page_size, passing the rest through", zap.Int64("size", size))
+			return rewriter.passThrough(raw, z.Buffered(), r)
+		}
+
+		if tt == html.DoctypeToken {
+			rewriter.startDocument()
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken && tt != html.EndTagToken {
+			if err := rewriter.write(raw, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		// Token lowercases the names in place, keep the markup as written.
+		raw = append([]byte(nil), raw...)
+		token := z.Token()
+		// The opt-out is only honored while the start of the page is held
+		// back, a page already partly rewritten is rewritten to the end.
+		if rewriter.head != nil && isOptOutMeta(token) {
+			p.logger.Debug("Page opted out with a meta element, passing the rest through")
+			return rewriter.passThrough(raw, z.Buffered(), r)
+		}
+		if endsHead(token) {
+			if err := rewriter.writeHead(); err != nil {
+				return err
+			}
+		}
+		rewriter.resolveBase(token, raw)
+		if err := rewriter.tag(token, raw); err != nil {
+			return err
+		}
+	}
+}
+
+// isOptOutMeta tells whether token is a <meta name="pixbooster" content="off">
+// element, asking for the page to be left alone.
+func isOptOutMeta(token html.Token) bool {
+	if token.Data != "meta" || token.Type == html.EndTagToken {
+		return false
+	}
+	name, _ := tokenAttr(token, "name")
+	content, _ := tokenAttr(token, "content")
+	return strings.EqualFold(name, "pixbooster") && strings.EqualFold(strings.TrimSpace(content), "off")
+}
+
+// endsHead tells whether token comes after the place of an opt-out <meta>
+// element: the end of the <head> or the first image.
+func endsHead(token html.Token) bool {
+	if token.Type == html.EndTagToken {
+		return token.Data == "head"
+	}
+	return token.Data == "img" || token.Data == "picture"
+}
+
+// htmlRewriter adds the optimized sources to the images of a page, token by
+// token.
+type htmlRewriter struct {
+	p *Pixbooster
+	w io.Writer
+	// Encoding of the page, nil for UTF-8.
+	enc encoding.Encoding
+	// Start of the page held back until it is known whether the page opts
+	// out, nil once written.
+	head []byte
+	// Tokens of the <picture> element being held back, and their size.
+	held     []heldToken
+	heldSize int
+	// Nesting level of the held <picture> elements.
+	pictures int
+	// Nesting level of the <picture> elements passed through untouched.
+	ignored int
+	// Whether a <base> element set the base URL of the page.
+	based bool
+}
+
+type heldToken struct {
+	raw   []byte
+	token *html.Token
+}
+
+// startDocument takes the page URL as the base URL, the page being a whole
+// document.
+func (h *htmlRewriter) startDocument() {
+	if h.p.baseURL == nil {
+		h.p.baseURL = h.p.pageURL
+	}
+}
+
+// resolveBase updates the base URL from token: the page is a whole document
+// from its <html>, <head> or <body> element, and its first <base> element
+// with an href sets the base URL.
+func (h *htmlRewriter) resolveBase(token html.Token, raw []byte) {
+	if token.Type == html.EndTagToken {
+		return
+	}
+	switch token.Data {
+	case "html", "head", "body":
+		h.startDocument()
+	case "base":
+		href, ok := tokenAttr(h.decodeTag(token, raw), "href")
+		if !ok || h.based {
+			return
+		}
+		h.based = true
+		baseURL, err := url.Parse(strings.TrimSpace(href))
+		if err != nil {
+			h.p.logger.Debug("Invalid base URL: " + err.Error())
+			return
+		}
+		if h.p.pageURL != nil {
+			baseURL = h.p.pageURL.ResolveReference(baseURL)
+		}
+		h.p.baseURL = baseURL
+	}
+}
+
+func (h *htmlRewriter) tag(token html.Token, raw []byte) error {
+	switch {
+	case token.Data == "picture" && token.Type == html.StartTagToken:
+		return h.openPicture(token, raw)
+	case token.Data == "picture" && token.Type == html.EndTagToken:
+		return h.closePicture(token, raw)
+	case token.Data == "img" && token.Type != html.EndTagToken && h.pictures == 0 && h.ignored == 0:
+		return h.wrapImg(token, raw)
+	default:
+		return h.write(raw, &token)
+	}
+}
+
+func (h *htmlRewriter) openPicture(token html.Token, raw []byte) error {
+	if h.pictures > 0 {
+		h.pictures++
+		return h.write(raw, &token)
+	}
+	if h.ignored > 0 || hasTokenAttr(token, "data-pixbooster-ignore") {
+		h.ignored++
+		return h.write(raw, &token)
+	}
+	h.pictures = 1
+	h.held = []heldToken{}
+	return h.write(raw, &token)
+}
+
+func (h *htmlRewriter) closePicture(token html.Token, raw []byte) error {
+	if h.pictures > 0 {
+		if err := h.write(raw, &token); err != nil {
+			return err
+		}
+		h.pictures--
+		if h.pictures == 0 {
+			return h.writePicture()
+		}
+		return nil
+	}
+	if h.ignored > 0 {
+		h.ignored--
+	}
+	return h.write(raw, &token)
+}
+
+// write writes raw, or holds it back along with its token while in a
+// <picture> element or in the start of the page.
+func (h *htmlRewriter) write(raw []byte, token *html.Token) error {
+	if h.head != nil {
+		h.head = append(h.head, raw...)
+		if len(h.head) > maxHeldHead {
+			h.p.logger.Debug("Page head too large, rewriting the page", zap.Int("size", len(h.head)))
+			return h.writeHead()
+		}
+		return nil
+	}
+	if h.held == nil {
+		_, err := h.w.Write(raw)
+		return err
+	}
+
+	if token == nil {
+		raw = append([]byte(nil), raw...)
+	}
+	h.held = append(h.held, heldToken{raw: raw, token: token})
+	h.heldSize += len(raw)
+	if h.heldSize <= maxHeldPicture {
+		return nil
+	}
+
+	h.p.logger.Debug("Picture element too large, passing it through", zap.Int("size", h.heldSize))
+	held := h.held
+	h.held, h.heldSize = nil, 0
+	h.ignored, h.pictures = h.pictures, 0
+	for _, t := range held {
+		if _, err := h.w.Write(t.raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePicture writes the held back <picture> element, adding the optimized
+// sources before each of its sources, or before its image if it has none.
+func (h *htmlRewriter) writePicture() error {
+	held := h.held
+	h.held, h.heldSize, h.pictures = nil, 0, 0
+
+	targets := make(map[int]bool)
+	for i, t := range held {
+		if t.token != nil && t.token.Type != html.EndTagToken && t.token.Data == "source" {
+			targets[i] = true
+		}
+	}
+	if len(targets) == 0 {
+		for i, t := range held {
+			if t.token != nil && t.token.Type != html.EndTagToken && t.token.Data == "img" {
+				targets[i] = true
+				break
+			}
+		}
+	}
+
+	for i, t := range held {
+		if targets[i] {
+			if err := h.writeTokens(h.p.optimizedSources(h.decodeTag(*t.token, t.raw))); err != nil {
+				return err
+			}
+		}
+		if _, err := h.w.Write(t.raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrapImg wraps an image out of any <picture> element in a new one, along
+// with its optimized sources.
+func (h *htmlRewriter) wrapImg(img html.Token, raw []byte) error {
+	src, _ := tokenAttr(img, "src")
+	if !h.p.isSameSite(src) || hasTokenAttr(img, "data-pixbooster-ignore") || !h.p.isSourceFormat(src) {
+		return h.write(raw, &img)
+	}
+
+	// Images without any source, e.g. whose URL can't be signed, are left
+	// as is.
+	decoded := h.decodeTag(img, raw)
+	sources := h.p.optimizedSources(decoded)
+	if len(sources) == 0 {
+		return h.write(raw, &img)
+	}
+
+	picture := html.Token{Type: html.StartTagToken, Data: "picture"}
+	for _, attr := range decoded.Attr {
+		if attr.Key != "src" && attr.Key != "alt" && attr.Key != "srcset" {
+			picture.Attr = append(picture.Attr, attr)
+		}
+	}
+
+	if err := h.writeTokens(append([]html.Token{picture}, sources...)); err != nil {
+		return err
+	}
+	if _, err := h.w.Write(raw); err != nil {
+		return err
+	}
+	return h.writeTokens([]html.Token{{Type: html.EndTagToken, Data: "picture"}})
+}
+
+// writeTokens writes tokens added to the page, in its encoding. Characters
+// which can't be encoded are written as character references.
+func (h *htmlRewriter) writeTokens(tokens []html.Token) error {
+	for _, token := range tokens {
+		markup := token.String()
+		if h.enc != nil {
+			var err error
+			markup, err = encoding.HTMLEscapeUnsupported(h.enc.NewEncoder()).String(markup)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(h.w, markup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeTag returns token, read from raw, with its attributes decoded from
+// the encoding of the page. Entities are only resolved once decoded, so the
+// tag is tokenized again.
+func (h *htmlRewriter) decodeTag(token html.Token, raw []byte) html.Token {
+	if h.enc == nil {
+		return token
+	}
+	decoded, err := h.enc.NewDecoder().Bytes(raw)
+	if err != nil {
+		return token
+	}
+	z := html.NewTokenizer(bytes.NewReader(decoded))
+	z.Next()
+	return z.Token()
+}
+
+// writeHead writes the held back start of the page, if any.
+func (h *htmlRewriter) writeHead() error {
+	if h.head == nil {
+		return nil
+	}
+	head := h.head
+	h.head = nil
+	_, err := h.w.Write(head)
+	return err
+}
+
+// passThrough writes the rest of the page untouched, starting with the
+// held back tokens, the current one and the data already buffered.
+func (h *htmlRewriter) passThrough(raw []byte, buffered []byte, r io.Reader) error {
+	if err := h.writeHead(); err != nil {
+		return err
+	}
+	for _, t := range h.held {
+		if _, err := h.w.Write(t.raw); err != nil {
+			return err
+		}
+	}
+	h.held = nil
+	if _, err := h.w.Write(raw); err != nil {
+		return err
+	}
+	if _, err := h.w.Write(buffered); err != nil {
+		return err
+	}
+	_, err := io.Copy(h.w, r)
+	return err
+}
+
+// optimizedSources returns the <source> elements to add before source, a
+// <source> or <img> element, for each enabled output format.
+func (p *Pixbooster) optimizedSources(source html.Token) []html.Token {
+	var sources []html.Token
+	if srcset, ok := tokenAttr(source, "srcset"); ok {
+		for _, format := range p.destFormats {
+			if !p.isOutputFormatAllowed(format) {
+				continue
+			}
+			optimizedSrcset, err := p.getOptimizedSrcset(srcset, format)
+			if err != nil {
+				p.logger.Debug("Unable to optimize " + srcset + ": " + err.Error())
+				continue
+			}
+			sources = append(sources, newSourceToken(source, optimizedSrcset, format.mimeType, source.Data == "source"))
+		}
+	}
+
+	src, _ := tokenAttr(source, "src")
+	if source.Data == "img" && src != "" && p.isSameSite(src) && p.isInputFormatAllowed(src) {
+		for _, format := range p.destFormats {
+			if !p.isOutputFormatAllowed(format) {
+				continue
+			}
+			if len(p.Widths) == 0 {
+				optimizedURL, err := p.getOptimizedImageURL(src, format)
+				if err == nil {
+					optimizedURL, err = p.signImageURL(optimizedURL)
+				}
+				if err != nil {
+					p.logger.Debug("Unable to optimize " + src + ": " + err.Error())
+					continue
+				}
+				sources = append(sources, newSourceToken(source, optimizedURL, format.mimeType, false))
+				continue
+			}
+			srcset, err := p.getResponsiveSrcset(src, format)
+			if err != nil {
+				p.logger.Debug("Unable to optimize " + src + ": " + err.Error())
+				continue
+			}
+			// The sizes of the image don't apply to its sources.
+			responsive := newSourceToken(source, srcset, format.mimeType, false)
+			sizes, ok := tokenAttr(source, "sizes")
+			if !ok {
+				sizes = p.Sizes
+			}
+			responsive.Attr = append(responsive.Attr, html.Attribute{Key: "sizes", Val: sizes})
+			sources = append(sources, responsive)
+		}
+	}
+	return sources
+}
+
+// isSourceFormat tells whether src has the extension of a supported input
+// format.
+func (p *Pixbooster) isSourceFormat(src string) bool {
+	mimeType := mime.TypeByExtension(filepath.Ext(src))
+	for _, format := range p.srcFormats {
+		if format.mimeType == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// newSourceToken returns a <source> element with srcset and type, copying the
+// other attributes of n if copyAttr is set. It is written as a self-closing
+// tag only if n is one, to blend in the markup around it.
+func newSourceToken(n html.Token, srcset string, mimeType string, copyAttr bool) html.Token {
+	source := html.Token{
+		Type: html.StartTagToken,
+		Data: "source",
+		Attr: make([]html.Attribute, 0, len(n.Attr)),
+	}
+	if n.Type == html.SelfClosingTagToken {
+		source.Type = html.SelfClosingTagToken
+	}
+
+	if copyAttr {
+		for _, attr := range n.Attr {
+			if attr.Key != "srcset" && attr.Key != "type" && attr.Key != "src" {
+				source.Attr = append(source.Attr, attr)
+			}
+		}
+	}
+
+	source.Attr = append(source.Attr,
+		html.Attribute{Key: "srcset", Val: srcset},
+		html.Attribute{Key: "type", Val: mimeType},
+	)
+	return source
+}
+
+func tokenAttr(token html.Token, name string) (string, bool) {
+	for _, attr := range token.Attr {
+		if attr.Key == name {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+func hasTokenAttr(token html.Token, name string) bool {
+	_, ok := tokenAttr(token, name)
+	return ok
+}
@@ -0,0 +1,334 @@
+package pixbooster
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// rewriteTest serves body as a page with header through p, and returns the
+// response.
+func rewriteTest(t *testing.T, p *Pixbooster, header http.Header, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		_, err := w.Write([]byte(body))
+		return err
+	})
+	return serveTest(t, p, next, http.MethodGet, "/page.html", nil)
+}
+
+// testSource returns the <source> element added for src by provisionTest.
+func testSource(p *Pixbooster, src string) string {
+	format := testFormat(p)
+	return `<source srcset="` + src + `.pixbooster` + format.extension + `" type="` + format.mimeType + `">`
+}
+
+func TestRewritePreservesMarkup(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	page := "<!DOCTYPE html>\n<HTML Lang=en><Head><META charset='utf-8'><title>A &amp; B</title></Head>\n" +
+		"<body class=x data-a = 'b'><!-- <img src=\"a.jpg\"> -->\n" +
+		"<script>if (a<b) { x = '<img src=q.jpg>' }</script>\n" +
+		"<p>café &eacute; &#x65e5;<br/><IMG SRC=a.gif></p>\n" +
+		"<img src=\"b.jpg\" data-pixbooster-ignore>\n" +
+		"<img src=\"https://elsewhere.example/c.jpg\">\n" +
+		"</body></HTML>\n"
+	w := rewriteTest(t, p, nil, page)
+	if got := w.Body.String(); got != page {
+		t.Errorf("page without images to rewrite changed:\n%s\nwant:\n%s", got, page)
+	}
+}
+
+func TestRewriteImages(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	tests := []struct {
+		name string
+		page string
+		want string
+	}{
+		{
+			name: "image",
+			page: `<p><IMG SRC='a.jpg' Alt=x class="c"></p>`,
+			want: `<p><picture class="c">` + testSource(p, "a.jpg") + `<IMG SRC='a.jpg' Alt=x class="c"></picture></p>`,
+		},
+		{
+			name: "self-closing image",
+			page: `<img src="a.jpg" />`,
+			want: `<picture>` + strings.TrimSuffix(testSource(p, "a.jpg"), ">") + `/>` + `<img src="a.jpg" /></picture>`,
+		},
+		{
+			name: "picture",
+			page: "<picture>\n  <source srcset=\"b.png\" type=\"image/png\" media=\"(min-width: 800px)\">\n  <img src=\"c.png\">\n</picture>",
+			want: "<picture>\n  " + strings.Replace(testSource(p, "b.png"), "<source ", `<source media="(min-width: 800px)" `, 1) +
+				"<source srcset=\"b.png\" type=\"image/png\" media=\"(min-width: 800px)\">\n  <img src=\"c.png\">\n</picture>",
+		},
+		{
+			name: "picture without sources",
+			page: `<picture><img src="c.png"></picture>`,
+			want: `<picture>` + testSource(p, "c.png") + `<img src="c.png"></picture>`,
+		},
+		{
+			name: "ignored picture",
+			page: `<picture data-pixbooster-ignore><img src="c.png"></picture>`,
+			want: `<picture data-pixbooster-ignore><img src="c.png"></picture>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := rewriteTest(t, p, nil, test.page)
+			if got := w.Body.String(); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRewriteFragments(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	for _, fragment := range []string{
+		`<tr><td>%s</td></tr>`,
+		`<div id="results">%s</div>`,
+		`%s<li>text</li>`,
+	} {
+		page := strings.Replace(fragment, "%s", `<img src="a.jpg">`, 1)
+		want := strings.Replace(fragment, "%s", `<picture>`+testSource(p, "a.jpg")+`<img src="a.jpg"></picture>`, 1)
+		w := rewriteTest(t, p, nil, page)
+		if got := w.Body.String(); got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	}
+}
+
+func TestRewriteHeaders(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	w := rewriteTest(t, p, http.Header{"Content-Length": {"17"}, "Etag": {`"abc"`}}, `<img src="a.jpg">`)
+	if w.Header().Get("Content-Length") != "" {
+		t.Error("Content-Length of the original page kept")
+	}
+	if got := w.Header().Get("ETag"); got != `W/"abc"` {
+		t.Errorf("got ETag %s, want a weak one", got)
+	}
+}
+
+func TestRewriteSkipsOtherResponses(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	page := `<img src="a.jpg">`
+	for _, header := range []http.Header{
+		{"Content-Type": {"application/json"}},
+		{"Cache-Control": {"public, No-Transform"}},
+		{"Content-Encoding": {"compress"}},
+	} {
+		w := rewriteTest(t, p, header, page)
+		if got := w.Body.String(); got != page {
+			t.Errorf("%v: got %s, want the page untouched", header, got)
+		}
+	}
+}
+
+func TestRewriteMaxPageSize(t *testing.T) {
+	p := &Pixbooster{MaxPageSize: 100}
+	provisionTest(t, p)
+
+	rest := `<p>` + strings.Repeat("x", 100) + `</p><img src="b.jpg">`
+	w := rewriteTest(t, p, nil, `<img src="a.jpg">`+rest)
+	want := `<picture>` + testSource(p, "a.jpg") + `<img src="a.jpg"></picture>` + rest
+	if got := w.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRewriteCompressed(t *testing.T) {
+	page := `<p>hi</p><img src="a.jpg">`
+	for _, recompress := range []bool{false, true} {
+		p := &Pixbooster{Recompress: recompress}
+		provisionTest(t, p)
+		want := `<p>hi</p><picture>` + testSource(p, "a.jpg") + `<img src="a.jpg"></picture>`
+
+		for _, encoding := range []string{encodingGzip, encodingDeflate, encodingBrotli, encodingZstd} {
+			var compressed bytes.Buffer
+			encoder, err := newEncoder(encoding, &compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoder.Write([]byte(page))
+			encoder.Close()
+
+			w := rewriteTest(t, p, http.Header{"Content-Encoding": {encoding}}, compressed.String())
+			body := w.Body.Bytes()
+			if got := w.Header().Get("Content-Encoding"); recompress != (got == encoding) {
+				t.Errorf("recompress %v, %s: got Content-Encoding %q", recompress, encoding, got)
+			}
+			if recompress {
+				decoder, err := newDecoder(encoding, bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ = io.ReadAll(decoder)
+			}
+			if string(body) != want {
+				t.Errorf("recompress %v, %s: got %s, want %s", recompress, encoding, body, want)
+			}
+		}
+	}
+}
+
+func TestRewriteEmptyBodies(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	for _, encoding := range []string{"", encodingGzip, encodingDeflate, encodingBrotli, encodingZstd} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", encoding)
+				w.Header().Set("Content-Length", "120")
+				w.WriteHeader(http.StatusOK)
+				return nil
+			})
+			w := serveTest(t, p, next, method, "/page.html", nil)
+			if w.Body.Len() != 0 {
+				t.Errorf("%s %q: got a body: %q", method, encoding, w.Body.String())
+			}
+			if w.Header().Get("Content-Length") != "" || w.Header().Get("Content-Encoding") != "" {
+				t.Errorf("%s %q: Content-Length or Content-Encoding of the original page kept", method, encoding)
+			}
+		}
+	}
+}
+
+func TestRewriteHeadAndNotModified(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	page := []byte(`<img src="a.jpg">`)
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"abc"`)
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(page)
+		gz.Close()
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+		return nil
+	})
+
+	get := serveTest(t, p, next, http.MethodGet, "/page.html", nil)
+	head := serveTest(t, p, next, http.MethodHead, "/page.html", nil)
+	for _, name := range []string{"Content-Encoding", "Content-Length", "ETag"} {
+		if get.Header().Get(name) != head.Header().Get(name) {
+			t.Errorf("%s: got %q for GET and %q for HEAD", name, get.Header().Get(name), head.Header().Get(name))
+		}
+	}
+	if got := get.Header().Get("ETag"); got != `W/"abc"` {
+		t.Errorf("got ETag %s, want a weak one", got)
+	}
+
+	notModified := serveTest(t, p, next, http.MethodGet, "/page.html", http.Header{"If-None-Match": {`W/"abc"`}})
+	if notModified.Code != http.StatusNotModified || notModified.Header().Get("ETag") != `W/"abc"` {
+		t.Errorf("got status %d and ETag %s, want 304 and the weak ETag", notModified.Code, notModified.Header().Get("ETag"))
+	}
+	notModified = serveTest(t, p, next, http.MethodGet, "/style.css", http.Header{"If-None-Match": {`"abc"`}})
+	if notModified.Header().Get("ETag") != `"abc"` {
+		t.Errorf("got ETag %s for a stylesheet, want it untouched", notModified.Header().Get("ETag"))
+	}
+}
+
+func TestRewriteSkipsPartialContent(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Range", "bytes 0-16/100")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(`<img src="a.jpg">`))
+		return nil
+	})
+	w := serveTest(t, p, next, http.MethodGet, "/page.html", nil)
+	if got := w.Body.String(); got != `<img src="a.jpg">` {
+		t.Errorf("got %s, want the range untouched", got)
+	}
+}
+
+func TestRewriteOptOut(t *testing.T) {
+	p := &Pixbooster{OptOutHeader: "X-Pixbooster"}
+	provisionTest(t, p)
+	image := `<picture>` + testSource(p, "a.jpg") + `<img src="a.jpg"></picture>`
+
+	tests := []struct {
+		name   string
+		header http.Header
+		page   string
+		want   string
+	}{
+		{
+			name: "meta in head",
+			page: `<html><head><title>x</title><meta name="pixbooster" content="off"></head><body><img src="a.jpg"></body></html>`,
+			want: `<html><head><title>x</title><meta name="pixbooster" content="off"></head><body><img src="a.jpg"></body></html>`,
+		},
+		{
+			name: "meta without head",
+			page: `<p>intro</p><META Name=Pixbooster Content=OFF><img src="a.jpg">`,
+			want: `<p>intro</p><META Name=Pixbooster Content=OFF><img src="a.jpg">`,
+		},
+		{
+			name: "meta after the first image",
+			page: `<img src="a.jpg"><meta name="pixbooster" content="off"><img src="a.jpg">`,
+			want: image + `<meta name="pixbooster" content="off">` + image,
+		},
+		{
+			name: "meta after the head",
+			page: `<head></head><meta name="pixbooster" content="off"><img src="a.jpg">`,
+			want: `<head></head><meta name="pixbooster" content="off">` + image,
+		},
+		{
+			name:   "header",
+			header: http.Header{"X-Pixbooster": {"off"}},
+			page:   `<img src="a.jpg">`,
+			want:   `<img src="a.jpg">`,
+		},
+		{
+			name:   "header on",
+			header: http.Header{"X-Pixbooster": {"on"}},
+			page:   `<img src="a.jpg">`,
+			want:   image,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := rewriteTest(t, p, test.header, test.page)
+			if got := w.Body.String(); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+			if w.Header().Get("X-Pixbooster") != "" {
+				t.Error("opt-out header not removed")
+			}
+		})
+	}
+}
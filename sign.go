@@ -0,0 +1,109 @@
+package pixbooster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Query parameter carrying the signature of a variant URL. It is always the
+// last one.
+const signatureParam = "sig"
+
+// errUnresolvable is returned for a relative image URL whose base isn't
+// known, as in HTML fragments.
+var errUnresolvable = errors.New("relative URL without a known base")
+
+// signImageURL appends a signature to variantURL when signing keys are
+// configured. The URL is signed as resolved against the base of the page
+// being rewritten, and written resolved, so that the browser requests the
+// signed URL whatever the context the markup ends up in.
+func (p *Pixbooster) signImageURL(variantURL string) (string, error) {
+	if len(p.SigningKeys) == 0 {
+		return variantURL, nil
+	}
+	resolved, err := p.resolveImageURL(variantURL)
+	if err != nil {
+		return "", err
+	}
+
+	signature := signURL(p.SigningKeys[0], resolved.EscapedPath(), resolved.RawQuery)
+	if resolved.RawQuery != "" {
+		resolved.RawQuery += "&"
+	}
+	resolved.RawQuery += signatureParam + "=" + signature
+	return resolved.String(), nil
+}
+
+// resolveImageURL resolves imageURL, found in the page being rewritten,
+// against its base. Path-relative URLs can't be resolved until the base is
+// known.
+func (p *Pixbooster) resolveImageURL(imageURL string) (*url.URL, error) {
+	parsedURL, err := url.Parse(imageURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.IsAbs() || parsedURL.Host != "" || strings.HasPrefix(parsedURL.Path, "/") {
+		return parsedURL, nil
+	}
+	if p.baseURL == nil {
+		return nil, fmt.Errorf("%w: %s", errUnresolvable, imageURL)
+	}
+	return p.baseURL.ResolveReference(parsedURL), nil
+}
+
+// hasValidSignature tells whether the URL requested by the client carries a
+// signature made with any of the signing keys.
+func (p *Pixbooster) hasValidSignature(r *http.Request) bool {
+	requested := requestedURL(r)
+	query, signature, ok := splitSignature(requested.RawQuery)
+	if !ok {
+		return false
+	}
+	for _, key := range p.SigningKeys {
+		expected := signURL(key, requested.EscapedPath(), query)
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return true
+		}
+	}
+	return false
+}
+
+// signURL returns the signature of a URL path and query: the HMAC-SHA256 of
+// "<path>?<query>", or "<path>" without a query, encoded in unpadded
+// base64url.
+func signURL(key string, path string, query string) string {
+	message := path
+	if query != "" {
+		message += "?" + query
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// splitSignature splits the signature parameter off the end of rawQuery.
+func splitSignature(rawQuery string) (string, string, bool) {
+	query, signature := "", rawQuery
+	if i := strings.LastIndex(rawQuery, "&"); i != -1 {
+		query, signature = rawQuery[:i], rawQuery[i+1:]
+	}
+	signature, ok := strings.CutPrefix(signature, signatureParam+"=")
+	return query, signature, ok && signature != ""
+}
+
+// requestedURL returns the URL requested by the client, before any rewrite
+// by the handlers preceding Pixbooster.
+func requestedURL(r *http.Request) *url.URL {
+	if original, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok {
+		return original.URL
+	}
+	return r.URL
+}
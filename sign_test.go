@@ -0,0 +1,113 @@
+package pixbooster
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSignatureRoundTrip(t *testing.T) {
+	p := &Pixbooster{SigningKeys: []string{"current", "previous"}}
+	p.baseURL, _ = url.Parse("/blog/post.html")
+
+	tests := map[string]string{
+		"/photos/a.jpg.pixbooster.webp":     "/photos/a.jpg.pixbooster.webp",
+		"/photos/a.jpg.pixbooster.webp?v=2": "/photos/a.jpg.pixbooster.webp?v=2",
+		"a.jpg.pixbooster.webp":             "/blog/a.jpg.pixbooster.webp",
+		"../a%20b.jpg.pixbooster.webp":      "/a%20b.jpg.pixbooster.webp",
+	}
+	for variantURL, requested := range tests {
+		signed, err := p.signImageURL(variantURL)
+		if err != nil || !strings.HasPrefix(signed, requested) {
+			t.Errorf("signImageURL(%q) = %q, %v, want %s followed by its signature", variantURL, signed, err, requested)
+			continue
+		}
+		r := httptest.NewRequest(http.MethodGet, signed, nil)
+		if !p.hasValidSignature(r) {
+			t.Errorf("signature of %q refused when requested as %s", variantURL, r.URL)
+		}
+	}
+
+	// The base of fragments is unknown.
+	p.baseURL = nil
+	if _, err := p.signImageURL("a.jpg.pixbooster.webp"); !errors.Is(err, errUnresolvable) {
+		t.Errorf("got %v for a relative URL without base, want errUnresolvable", err)
+	}
+	if _, err := p.signImageURL("/a.jpg.pixbooster.webp"); err != nil {
+		t.Errorf("got %v for an absolute path without base", err)
+	}
+}
+
+func TestSignatureRefused(t *testing.T) {
+	p := &Pixbooster{SigningKeys: []string{"current", "previous"}}
+	path := "/a.jpg.pixbooster.webp"
+
+	tests := map[string]bool{
+		path + "?sig=" + signURL("current", path, ""):         true,
+		path + "?sig=" + signURL("previous", path, ""):        true,
+		path + "?v=1&sig=" + signURL("previous", path, "v=1"): true,
+		path:           false,
+		path + "?sig=": false,
+		path + "?sig=" + signURL("other", path, ""):                  false,
+		path + "?v=2&sig=" + signURL("current", path, "v=1"):         false,
+		path + "?sig=" + signURL("current", path, "") + "&v=1":       false,
+		"/b.jpg.pixbooster.webp?sig=" + signURL("current", path, ""): false,
+	}
+	for target, valid := range tests {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if got := p.hasValidSignature(r); got != valid {
+			t.Errorf("hasValidSignature(%s) = %v, want %v", target, got, valid)
+		}
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	p := &Pixbooster{SigningKeys: []string{"key"}}
+	_, next := provisionTest(t, p)
+	path := "/a.jpg.pixbooster" + testFormat(p).extension
+
+	if w := serveTest(t, p, next, http.MethodGet, path, nil); w.Code != http.StatusForbidden {
+		t.Errorf("unsigned: got status %d, want 403", w.Code)
+	}
+	if w := serveTest(t, p, next, http.MethodGet, path+"?sig="+signURL("key", path, ""), nil); w.Code != http.StatusOK {
+		t.Errorf("signed: got status %d, want 200", w.Code)
+	}
+	if w := serveTest(t, p, next, http.MethodGet, "/a.jpg", nil); w.Code != http.StatusOK {
+		t.Errorf("original image: got status %d, want 200", w.Code)
+	}
+}
+
+func TestRewriteSignedURLs(t *testing.T) {
+	p := &Pixbooster{SigningKeys: []string{"key"}}
+	provisionTest(t, p)
+	format := testFormat(p)
+	signed := func(path string) string {
+		return path + "?sig=" + signURL("key", path, "")
+	}
+
+	tests := []struct {
+		page string
+		want string
+	}{
+		{
+			page: `<!DOCTYPE html><img src="a.jpg">`,
+			want: `<!DOCTYPE html><picture><source srcset="` + signed("/a.jpg.pixbooster"+format.extension) + `" type="` + format.mimeType + `"><img src="a.jpg"></picture>`,
+		},
+		{
+			page: `<head><base href="/photos/"></head><img src="a.jpg">`,
+			want: `<head><base href="/photos/"></head><picture><source srcset="` + signed("/photos/a.jpg.pixbooster"+format.extension) + `" type="` + format.mimeType + `"><img src="a.jpg"></picture>`,
+		},
+		{
+			page: `<div><img src="a.jpg"><img src="/b.jpg"></div>`,
+			want: `<div><img src="a.jpg"><picture><source srcset="` + signed("/b.jpg.pixbooster"+format.extension) + `" type="` + format.mimeType + `"><img src="/b.jpg"></picture></div>`,
+		},
+	}
+	for _, test := range tests {
+		if got := rewriteTest(t, p, nil, test.page).Body.String(); got != test.want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package pixbooster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Ways to read the original images.
+const (
+	// Read the files straight from the site root.
+	sourceRoot = "root"
+	// Issue an in-process request through the next handlers.
+	sourceSubrequest = "subrequest"
+	// Issue an HTTP request to the server itself.
+	sourceLoopback = "loopback"
+)
+
+// originalImage holds the content of an original image along with the
+// metadata known about it.
+type originalImage struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+	etag        string
+}
+
+func isValidSource(source string) bool {
+	switch source {
+	case sourceRoot, sourceSubrequest, sourceLoopback:
+		return true
+	default:
+		return false
+	}
+}
+
+// loadOriginal reads the original image located at originalURI with the
+// configured source, giving up after FetchTimeout.
+func (p *Pixbooster) loadOriginal(r *http.Request, next caddyhttp.Handler, originalURI string) (*originalImage, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(p.FetchTimeout))
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	switch p.Source {
+	case sourceRoot:
+		return p.loadOriginalFromRoot(r, originalURI)
+	case sourceSubrequest:
+		return p.loadOriginalFromSubrequest(r, next, originalURI)
+	case sourceLoopback:
+		return p.loadOriginalFromLoopback(ctx, originalURI)
+	default:
+		return nil, fmt.Errorf("unknown original image source: %s", p.Source)
+	}
+}
+
+func (p *Pixbooster) loadOriginalFromRoot(r *http.Request, originalURI string) (*originalImage, error) {
+	parsedURI, err := url.Parse(originalURI)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := p.getRootFileName(r, parsedURI.Path)
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("original image is a directory: %s", filename)
+	}
+	if err := p.checkInputSize(info.Size()); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &originalImage{
+		data:        data,
+		contentType: mime.TypeByExtension(filepath.Ext(filename)),
+		modTime:     info.ModTime(),
+	}, nil
+}
+
+// getRootFileName returns the path of the file serving urlPath in the site root.
+func (p *Pixbooster) getRootFileName(r *http.Request, urlPath string) string {
+	root := p.Root
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		root = repl.ReplaceAll(root, ".")
+	}
+	return caddyhttp.SanitizedPathJoin(root, urlPath)
+}
+
+func (p *Pixbooster) loadOriginalFromSubrequest(r *http.Request, next caddyhttp.Handler, originalURI string) (*originalImage, error) {
+	if next == nil {
+		return nil, fmt.Errorf("no next handler to request the original image from")
+	}
+	parsedURI, err := url.Parse(originalURI)
+	if err != nil {
+		return nil, err
+	}
+
+	subreq := newSubrequest(r, http.MethodGet, parsedURI, originalURI)
+	rec := newBufferedResponse()
+	rec.maxSize = p.MaxInputSize
+	err = next.ServeHTTP(rec, subreq)
+	if rec.truncated {
+		return nil, fmt.Errorf("%w: more than %d bytes, max_input_size is %d", errLimitExceeded, rec.maxSize, p.MaxInputSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.status != http.StatusOK {
+		return nil, fmt.Errorf("original image subrequest returned status %d: %s", rec.status, originalURI)
+	}
+
+	return newOriginalImageFromResponse(rec.header, rec.body.Bytes(), parsedURI.Path), nil
+}
+
+// newSubrequest clones r to request originalURI without the headers that could
+// alter the response body.
+func newSubrequest(r *http.Request, method string, parsedURI *url.URL, originalURI string) *http.Request {
+	subreq := r.Clone(r.Context())
+	subreq.Method = method
+	subreq.URL.Path = parsedURI.Path
+	subreq.URL.RawPath = parsedURI.RawPath
+	subreq.URL.RawQuery = parsedURI.RawQuery
+	subreq.RequestURI = originalURI
+	subreq.Body = http.NoBody
+	subreq.ContentLength = 0
+	for _, header := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "Accept-Encoding"} {
+		subreq.Header.Del(header)
+	}
+	return subreq
+}
+
+func (p *Pixbooster) loadOriginalFromLoopback(ctx context.Context, originalURI string) (*originalImage, error) {
+	client, err := p.originClient(p.rootURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.rootURL+originalURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("original image request returned status %d: %s", resp.StatusCode, originalURI)
+	}
+	if err := p.checkInputSize(resp.ContentLength); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, p.MaxInputSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkInputSize(int64(len(data))); err != nil {
+		return nil, err
+	}
+
+	return newOriginalImageFromResponse(resp.Header, data, resp.Request.URL.Path), nil
+}
+
+// How long the fingerprint of an original image is reused before being
+// checked again.
+const fingerprintTTL = 10 * time.Second
+
+// fingerprintCache keeps the fingerprints of the original images for
+// fingerprintTTL, so that serving a stored variant doesn't cost a request
+// for the original image every time.
+type fingerprintCache struct {
+	mu        sync.Mutex
+	entries   map[string]fingerprintEntry
+	lastPrune time.Time
+}
+
+type fingerprintEntry struct {
+	fingerprint string
+	expiry      time.Time
+}
+
+func newFingerprintCache() *fingerprintCache {
+	return &fingerprintCache{entries: make(map[string]fingerprintEntry)}
+}
+
+func (f *fingerprintCache) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry, ok := f.entries[key]
+	if !ok || time.Now().After(entry.expiry) {
+		return "", false
+	}
+	return entry.fingerprint, true
+}
+
+func (f *fingerprintCache) add(key string, fingerprint string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if now.Sub(f.lastPrune) > fingerprintTTL {
+		for k, entry := range f.entries {
+			if now.After(entry.expiry) {
+				delete(f.entries, k)
+			}
+		}
+		f.lastPrune = now
+	}
+	f.entries[key] = fingerprintEntry{fingerprint: fingerprint, expiry: now.Add(fingerprintTTL)}
+}
+
+// fingerprintOriginal returns a string changing whenever the original image
+// located at originalURI changes, without reading its content if possible.
+// A replaced image may keep its previous fingerprint for fingerprintTTL.
+func (p *Pixbooster) fingerprintOriginal(r *http.Request, next caddyhttp.Handler, originalURI string) (string, error) {
+	key := r.Host + originalURI
+	if fingerprint, ok := p.fingerprints.get(key); ok {
+		return fingerprint, nil
+	}
+	fingerprint, err := p.fetchFingerprint(r, next, originalURI)
+	if err != nil {
+		return "", err
+	}
+	p.fingerprints.add(key, fingerprint)
+	return fingerprint, nil
+}
+
+// fetchFingerprint fingerprints the original image located at originalURI
+// with the configured source, giving up after FetchTimeout.
+func (p *Pixbooster) fetchFingerprint(r *http.Request, next caddyhttp.Handler, originalURI string) (string, error) {
+	parsedURI, err := url.Parse(originalURI)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(p.FetchTimeout))
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	switch p.Source {
+	case sourceRoot:
+		info, err := os.Stat(p.getRootFileName(r, parsedURI.Path))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+	case sourceSubrequest:
+		if next == nil {
+			return "", fmt.Errorf("no next handler to request the original image from")
+		}
+		rec := newBufferedResponse()
+		if err := next.ServeHTTP(rec, newSubrequest(r, http.MethodHead, parsedURI, originalURI)); err != nil {
+			return "", err
+		}
+		if rec.status != http.StatusOK {
+			return "", fmt.Errorf("original image subrequest returned status %d: %s", rec.status, originalURI)
+		}
+		return fingerprintFromHeader(rec.header), nil
+	case sourceLoopback:
+		client, err := p.originClient(p.rootURL)
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.rootURL+originalURI, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("original image request returned status %d: %s", resp.StatusCode, originalURI)
+		}
+		return fingerprintFromHeader(resp.Header), nil
+	default:
+		return "", fmt.Errorf("unknown original image source: %s", p.Source)
+	}
+}
+
+// fingerprintFromHeader uses the validators of a response to identify the
+// version of its content.
+func fingerprintFromHeader(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return header.Get("Last-Modified") + "-" + header.Get("Content-Length")
+}
+
+func newOriginalImageFromResponse(header http.Header, data []byte, path string) *originalImage {
+	original := &originalImage{
+		data:        data,
+		contentType: header.Get("Content-Type"),
+		etag:        header.Get("ETag"),
+	}
+	if original.contentType == "" {
+		original.contentType = mime.TypeByExtension(filepath.Ext(path))
+	}
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		original.modTime = lastModified
+	}
+	return original
+}
+
+// bufferedResponse is a minimal in-memory http.ResponseWriter used to
+// capture subrequest responses.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	// Maximum size of the body if positive, beyond which writes fail.
+	maxSize   int64
+	truncated bool
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	if b.maxSize > 0 && int64(b.body.Len()+len(data)) > b.maxSize {
+		b.truncated = true
+		return 0, errLimitExceeded
+	}
+	return b.body.Write(data)
+}
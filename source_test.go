@@ -0,0 +1,43 @@
+package pixbooster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestLoopbackFetchTimeout(t *testing.T) {
+	// An origin answering only once the client has given up.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	p := &Pixbooster{
+		Source:         sourceLoopback,
+		TrustedOrigins: []string{server.URL},
+		FetchTimeout:   caddy.Duration(100 * time.Millisecond),
+		MaxInputSize:   defaultMaxInputSize,
+		logger:         zap.NewNop(),
+	}
+	if err := p.provisionOrigins(); err != nil {
+		t.Fatal(err)
+	}
+	p.rootURL = server.URL
+
+	r := httptest.NewRequest(http.MethodGet, "/a.jpg.pixbooster.avif", nil)
+	start := time.Now()
+	if _, err := p.loadOriginal(r, nil, "/a.jpg"); err == nil {
+		t.Error("expected an error from a hanging origin")
+	}
+	if _, err := p.fetchFingerprint(r, nil, "/a.jpg"); err == nil {
+		t.Error("expected an error fingerprinting from a hanging origin")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %s, want about twice fetch_timeout", elapsed)
+	}
+}
@@ -0,0 +1,254 @@
+package pixbooster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// Suffix of the sidecar files holding the checksum of the stored variants.
+const checksumSuffix = ".sha256"
+
+// Prefix of the keys of the variants kept in a Caddy storage module.
+const storagePrefix = "pixbooster"
+
+// variantStore persists the optimized images. Missing entries are reported
+// with fs.ErrNotExist. The modification time returned by load may be zero
+// when the store can't tell it without another round trip.
+type variantStore interface {
+	load(ctx context.Context, key string) ([]byte, time.Time, error)
+	store(ctx context.Context, key string, data []byte) error
+	remove(ctx context.Context, key string) error
+	list(ctx context.Context) ([]storedVariant, error)
+}
+
+type storedVariant struct {
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+// loadVariant reads the variant stored under key. A corrupted variant is
+// removed and reported as missing, so that it gets converted again.
+func (p *Pixbooster) loadVariant(ctx context.Context, key string) ([]byte, time.Time, error) {
+	data, modTime, err := p.variants.load(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	size := int64(len(data))
+	if p.VerifyChecksums {
+		expected, _, err := p.variants.load(ctx, key+checksumSuffix)
+		if err != nil || strings.TrimSpace(string(expected)) != checksum(data) {
+			p.logger.Warn("Discarding corrupted optimized image: " + key)
+			p.removeVariant(ctx, key)
+			return nil, time.Time{}, fs.ErrNotExist
+		}
+		size += int64(len(expected))
+	}
+
+	if modTime.IsZero() {
+		var ok bool
+		if modTime, ok = p.cacheIndex.created(key); !ok {
+			// Stored by another instance since the storage was scanned:
+			// index it, so that its time stays the same from one request
+			// to the other and it gets evicted like the others.
+			modTime = time.Now()
+			p.cacheIndex.add(key, size, modTime)
+		}
+	}
+	p.cacheIndex.touch(key)
+	return data, modTime, nil
+}
+
+// storeVariant writes data under key, along with its checksum if enabled.
+// The checksum is written first, so that a concurrent loadVariant never finds
+// the variant without it.
+func (p *Pixbooster) storeVariant(ctx context.Context, key string, data []byte) error {
+	p.hotCache.remove(key)
+	size := int64(len(data))
+	if p.VerifyChecksums {
+		sum := checksum(data)
+		if err := p.variants.store(ctx, key+checksumSuffix, []byte(sum)); err != nil {
+			return err
+		}
+		size += int64(len(sum))
+	}
+	if err := p.variants.store(ctx, key, data); err != nil {
+		if p.VerifyChecksums {
+			p.variants.remove(ctx, key+checksumSuffix)
+		}
+		return err
+	}
+	p.cacheIndex.add(key, size, time.Now())
+	return nil
+}
+
+// removeVariant deletes the variant stored under key.
+func (p *Pixbooster) removeVariant(ctx context.Context, key string) {
+	if err := p.variants.remove(ctx, key); err != nil {
+		p.logger.Warn("Unable to remove optimized image: " + err.Error())
+	}
+	p.variants.remove(ctx, key+checksumSuffix)
+	p.cacheIndex.remove(key)
+	p.hotCache.remove(key)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileStore keeps the variants as files of a local directory.
+type fileStore struct {
+	dir string
+}
+
+func (f fileStore) load(ctx context.Context, key string) ([]byte, time.Time, error) {
+	filename := filepath.Join(f.dir, key)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, info.ModTime(), nil
+}
+
+// store writes the file next to its final location then renames it, so that
+// readers never see a partial file.
+func (f fileStore) store(ctx context.Context, key string, data []byte) error {
+	return writeFileAtomic(filepath.Join(f.dir, key), data)
+}
+
+func (f fileStore) remove(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(f.dir, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// list returns the files of the directory. Temporary files left behind by
+// interrupted writes are removed along the way.
+func (f fileStore) list(ctx context.Context) ([]storedVariant, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var variants []storedVariant
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-") {
+			if time.Since(info.ModTime()) > time.Hour {
+				os.Remove(filepath.Join(f.dir, name))
+			}
+			continue
+		}
+		variants = append(variants, storedVariant{key: name, size: info.Size(), modTime: info.ModTime()})
+	}
+	return variants, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of
+// filename, syncs it to disk and renames it to filename.
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	// Persist the rename itself, not supported on every platform.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// certmagicStore keeps the variants in a Caddy storage module, which may be
+// shared by several Caddy instances.
+type certmagicStore struct {
+	storage certmagic.Storage
+}
+
+// load doesn't return the modification time, which would take a Stat round
+// trip on top of the Load one.
+func (c certmagicStore) load(ctx context.Context, key string) ([]byte, time.Time, error) {
+	data, err := c.storage.Load(ctx, path.Join(storagePrefix, key))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, time.Time{}, nil
+}
+
+func (c certmagicStore) store(ctx context.Context, key string, data []byte) error {
+	return c.storage.Store(ctx, path.Join(storagePrefix, key), data)
+}
+
+func (c certmagicStore) remove(ctx context.Context, key string) error {
+	err := c.storage.Delete(ctx, path.Join(storagePrefix, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (c certmagicStore) list(ctx context.Context) ([]storedVariant, error) {
+	keys, err := c.storage.List(ctx, storagePrefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	variants := make([]storedVariant, 0, len(keys))
+	for _, key := range keys {
+		info, err := c.storage.Stat(ctx, key)
+		if err != nil || !info.IsTerminal {
+			continue
+		}
+		variants = append(variants, storedVariant{key: path.Base(key), size: info.Size, modTime: info.Modified})
+	}
+	return variants, nil
+}
@@ -0,0 +1,127 @@
+package pixbooster
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "variant")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(filename, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(filename); err != nil || string(data) != content {
+			t.Errorf("got %q, %v, want %q", data, err, content)
+		}
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("got mode %v, want 0644", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want no temporary file left", len(entries))
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "variant"), nil); err == nil {
+		t.Error("expected an error writing to a missing directory")
+	}
+}
+
+func TestCorruptedVariant(t *testing.T) {
+	p := &Pixbooster{VerifyChecksums: true}
+	_, original := provisionTest(t, p)
+	format := testFormat(p)
+
+	fetches := 0
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method == http.MethodGet {
+			fetches++
+		}
+		return original.ServeHTTP(w, r)
+	})
+	serve := func() []byte {
+		t.Helper()
+		w := serveTest(t, p, next, http.MethodGet, "/a.jpg.pixbooster"+format.extension, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d", w.Code)
+		}
+		return w.Body.Bytes()
+	}
+
+	want := serve()
+	entries, err := os.ReadDir(p.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), checksumSuffix) {
+			key = entry.Name()
+		}
+	}
+	sidecar, err := os.ReadFile(filepath.Join(p.Storage, key+checksumSuffix))
+	if err != nil || string(sidecar) != checksum(want) {
+		t.Fatalf("got checksum %q, %v, want %q", sidecar, err, checksum(want))
+	}
+
+	// Flip a byte of the stored variant, as a bad disk would.
+	corrupted := append([]byte(nil), want...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if err := os.WriteFile(filepath.Join(p.Storage, key), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := serve(); string(got) != string(want) {
+		t.Error("the corrupted variant was served")
+	}
+	if fetches != 2 {
+		t.Errorf("the original image was fetched %d times, want 2", fetches)
+	}
+	if data, err := os.ReadFile(filepath.Join(p.Storage, key)); err != nil || checksum(data) != checksum(want) {
+		t.Errorf("the corrupted variant wasn't replaced: %v", err)
+	}
+}
+
+func TestLoadVariantStoredElsewhere(t *testing.T) {
+	p := &Pixbooster{}
+	provisionTest(t, p)
+	store := certmagicStore{storage: &certmagic.FileStorage{Path: t.TempDir()}}
+	p.variants = store
+
+	// Another instance stores a variant after the storage was scanned.
+	ctx := context.Background()
+	if err := store.store(ctx, "variant", []byte("stored elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, first, err := p.loadVariant(ctx, "variant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, second, err := p.loadVariant(ctx, "variant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.IsZero() || !first.Equal(second) {
+		t.Errorf("got modification times %v and %v, want the same one", first, second)
+	}
+	if created, ok := p.cacheIndex.created("variant"); !ok || !created.Equal(first) {
+		t.Error("the variant wasn't indexed")
+	}
+}
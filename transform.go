@@ -0,0 +1,217 @@
+package pixbooster
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/jpegxl"
+)
+
+// Keys of the transformation options, in their normalized order.
+var transformKeys = []string{"w", "h", "fit", "g", "q", "f"}
+
+// Format option letting the Accept header of the client pick the format.
+const formatAuto = "auto"
+
+// Largest width or height which can be requested through the transformation
+// API.
+const maxTransformDimension = 8192
+
+// isTransformRequest tells whether r is a request of the transformation API,
+// either under TransformPath or, with TransformQuery, with transformation
+// options in the query of an original image.
+func (p *Pixbooster) isTransformRequest(r *http.Request) bool {
+	if p.TransformPath == "" {
+		return false
+	}
+	if strings.HasPrefix(r.URL.Path, p.TransformPath+"/") {
+		return true
+	}
+	if !p.TransformQuery || !p.isInputFormatAllowed(r.URL.Path) {
+		return false
+	}
+	query := r.URL.Query()
+	for _, key := range transformKeys {
+		if query.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTransform serves a request of the transformation API, e.g.
+// /_pixbooster/w:800,h:600,fit:cover,q:60,f:avif/photos/a.jpg or
+// /photos/a.jpg?w=800&h=600&fit=cover&q=60&f=avif.
+func (p *Pixbooster) serveTransform(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	var options [][2]string
+	original := *r.URL
+	if rest, ok := strings.CutPrefix(r.URL.Path, p.TransformPath+"/"); ok {
+		optionsPart, originalPath, found := strings.Cut(rest, "/")
+		if !found {
+			http.Error(w, "Missing image path", http.StatusBadRequest)
+			return nil
+		}
+		for _, option := range strings.Split(optionsPart, ",") {
+			key, value, found := strings.Cut(option, ":")
+			if !found {
+				http.Error(w, "Invalid transformation option: "+option, http.StatusBadRequest)
+				return nil
+			}
+			options = append(options, [2]string{key, value})
+		}
+		original.Path, original.RawPath = "/"+originalPath, ""
+		original.RawQuery = p.filterQuery(r.URL.RawQuery)
+	} else {
+		query := r.URL.Query()
+		for _, key := range transformKeys {
+			if query.Has(key) {
+				options = append(options, [2]string{key, query.Get(key)})
+			}
+		}
+		original.RawQuery = p.filterQuery(r.URL.RawQuery, transformKeys...)
+	}
+	originalURI := original.RequestURI()
+
+	if !p.isInputFormatAllowed(original.Path) {
+		http.Error(w, "Unsupported image format", http.StatusBadRequest)
+		return nil
+	}
+	transform, formatName, err := parseTransformOptions(options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	format, ok := p.transformFormat(w, r, formatName)
+	if !ok {
+		http.Error(w, "Unsupported image format", http.StatusBadRequest)
+		return nil
+	}
+
+	optimizedPath := p.TransformPath + "/" + normalizeTransform(transform, format) + originalURI
+	p.logger.Debug("Transformed image URL: " + optimizedPath)
+	return p.serveOptimizedImage(w, r, next, optimizedPath, originalURI, format, transform)
+}
+
+// parseTransformOptions parses transformation options given as key and value
+// pairs. It returns the transformation and the name of the requested format.
+func parseTransformOptions(options [][2]string) (imgTransform, string, error) {
+	transform := imgTransform{fit: fitCover, gravity: "center"}
+	formatName := formatAuto
+	for _, option := range options {
+		key, value := option[0], option[1]
+		switch key {
+		case "w", "h":
+			dimension, err := strconv.Atoi(value)
+			if err != nil || dimension <= 0 || dimension > maxTransformDimension {
+				return imgTransform{}, "", fmt.Errorf("invalid %s value: %s", key, value)
+			}
+			if key == "w" {
+				transform.width = dimension
+			} else {
+				transform.height = dimension
+			}
+		case "fit":
+			switch value {
+			case fitContain, fitCover, fitFill, fitInside:
+				transform.fit = value
+			default:
+				return imgTransform{}, "", fmt.Errorf("invalid fit value: %s", value)
+			}
+		case "g":
+			if _, ok := gravities[value]; !ok {
+				return imgTransform{}, "", fmt.Errorf("invalid g value: %s", value)
+			}
+			transform.gravity = value
+		case "q":
+			quality, err := strconv.Atoi(value)
+			if err != nil || quality < 1 || quality > 100 {
+				return imgTransform{}, "", fmt.Errorf("invalid q value: %s", value)
+			}
+			transform.quality = quality
+		case "f":
+			formatName = value
+		default:
+			return imgTransform{}, "", fmt.Errorf("unknown transformation option: %s", key)
+		}
+	}
+	return transform, formatName, nil
+}
+
+// transformFormat returns the output format named formatName. The "auto"
+// format is negotiated from the Accept header of the client, falling back to
+// the most widely supported enabled format: WebP, or AVIF in builds without
+// CGO or with WebP disabled.
+func (p *Pixbooster) transformFormat(w http.ResponseWriter, r *http.Request, formatName string) (imgFormat, bool) {
+	if formatName != formatAuto {
+		for _, format := range p.destFormats {
+			if format.extension == "."+formatName && p.isOutputFormatAllowed(format) {
+				return format, true
+			}
+		}
+		return imgFormat{}, false
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if format, ok := p.negotiateFormat(r); ok {
+		return format, true
+	}
+	var fallback imgFormat
+	for _, format := range p.destFormats {
+		if p.isOutputFormatAllowed(format) {
+			fallback = format
+		}
+	}
+	return fallback, fallback.extension != ""
+}
+
+// normalizeTransform returns the canonical form of the options of a
+// transformation, so that equivalent requests share the same variant.
+func normalizeTransform(transform imgTransform, format imgFormat) string {
+	// The fit mode and the gravity only apply when both dimensions are set.
+	if transform.width == 0 || transform.height == 0 {
+		transform.fit, transform.gravity = "", ""
+	}
+	values := []string{
+		strconv.Itoa(transform.width),
+		strconv.Itoa(transform.height),
+		transform.fit,
+		transform.gravity,
+		strconv.Itoa(transform.quality),
+		strings.TrimPrefix(format.extension, "."),
+	}
+	parts := make([]string, len(transformKeys))
+	for i, key := range transformKeys {
+		parts[i] = key + ":" + values[i]
+	}
+	return strings.Join(parts, ",")
+}
+
+// encoderOptions returns the options of the encoders, with the quality of
+// transform if set.
+func (p *Pixbooster) encoderOptions(transform imgTransform) (WebpConfig, avif.Options, jpegxl.Options) {
+	webpConfig, avifConfig, jxlConfig := p.WebpConfig, p.AvifConfig, p.JxlConfig
+	if transform.quality > 0 {
+		webpConfig.Quality = transform.quality
+		avifConfig.Quality = transform.quality
+		avifConfig.QualityAlpha = transform.quality
+		jxlConfig.Quality = transform.quality
+	}
+	return webpConfig, avifConfig, jxlConfig
+}
+
+// isValidTransformPath tells whether path can prefix the URLs of the
+// transformation API.
+func isValidTransformPath(path string) bool {
+	parsed, err := url.Parse(path)
+	return err == nil && parsed.Path == path && strings.HasPrefix(path, "/") && path != "/"
+}
@@ -0,0 +1,171 @@
+package pixbooster
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestTransformQueryOptIn(t *testing.T) {
+	p := &Pixbooster{TransformPath: "/_pixbooster"}
+	_, next := provisionTest(t, p)
+	format := testFormat(p)
+
+	w := serveTest(t, p, next, http.MethodGet, "/a.jpg?w=wide", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("without transform_query: got status %d and type %q, want the original image", w.Code, w.Header().Get("Content-Type"))
+	}
+	w = serveTest(t, p, next, http.MethodGet, "/_pixbooster/w:32/a.jpg", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != format.mimeType {
+		t.Errorf("path form: got status %d and type %q, want 200 and %q", w.Code, w.Header().Get("Content-Type"), format.mimeType)
+	}
+
+	p.TransformQuery = true
+	w = serveTest(t, p, next, http.MethodGet, "/a.jpg?w=32", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != format.mimeType {
+		t.Errorf("query form: got status %d and type %q, want 200 and %q", w.Code, w.Header().Get("Content-Type"), format.mimeType)
+	}
+	w = serveTest(t, p, next, http.MethodGet, "/a.jpg?w=wide", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid query option: got status %d, want 400", w.Code)
+	}
+}
+
+func TestTransformQueryRequiresPath(t *testing.T) {
+	p := &Pixbooster{TransformQuery: true, Storage: t.TempDir()}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := p.Provision(ctx); err == nil {
+		t.Error("expected an error for transform_query without transform_path")
+	}
+}
+
+// testGradient returns an opaque image whose red and green channels are the
+// x and y coordinates of each pixel.
+func testGradient(width int, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	return img
+}
+
+func TestTransformImageBounds(t *testing.T) {
+	src := testGradient(200, 100)
+	tests := []struct {
+		transform     imgTransform
+		width, height int
+	}{
+		{imgTransform{}, 200, 100},
+		{imgTransform{width: 100}, 100, 50},
+		{imgTransform{height: 50}, 100, 50},
+		{imgTransform{width: 400}, 200, 100},
+		{imgTransform{width: 100, height: 100, fit: fitCover}, 100, 100},
+		{imgTransform{width: 100, height: 100, fit: fitContain}, 100, 100},
+		{imgTransform{width: 100, height: 100, fit: fitInside}, 100, 50},
+		{imgTransform{width: 100, height: 100, fit: fitFill}, 100, 100},
+		{imgTransform{width: 400, height: 400, fit: fitCover}, 100, 100},
+		{imgTransform{width: 300, height: 50, fit: fitFill}, 200, 33},
+	}
+	for _, test := range tests {
+		bounds := transformImage(src, test.transform).Bounds()
+		if bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Errorf("%+v: got %dx%d, want %dx%d", test.transform, bounds.Dx(), bounds.Dy(), test.width, test.height)
+		}
+	}
+}
+
+func TestTransformImageGravity(t *testing.T) {
+	offsets := map[string]image.Point{
+		"center":    {50, 25},
+		"north":     {50, 0},
+		"south":     {50, 50},
+		"east":      {100, 25},
+		"west":      {0, 25},
+		"northeast": {100, 0},
+		"northwest": {0, 0},
+		"southeast": {100, 50},
+		"southwest": {0, 50},
+	}
+	for gravity, want := range offsets {
+		if got := anchorOffset(image.Pt(200, 100), image.Pt(100, 50), gravities[gravity]); got != want {
+			t.Errorf("%s: got offset %v, want %v", gravity, got, want)
+		}
+	}
+
+	// A 100x100 box covered by a 200x100 image crops it horizontally.
+	src := testGradient(200, 100)
+	for gravity, left := range map[string]uint8{"west": 0, "center": 50, "east": 100} {
+		img := transformImage(src, imgTransform{width: 100, height: 100, fit: fitCover, gravity: gravity})
+		if r, _, _, _ := img.At(0, 0).RGBA(); absDiff(uint8(r>>8), left) > 2 {
+			t.Errorf("cover %s: left edge at x=%d, want %d", gravity, r>>8, left)
+		}
+	}
+
+	// Contained in a 100x100 box, the image is 100x50 and padded.
+	for gravity, transparentY := range map[string]int{"north": 75, "south": 25} {
+		img := transformImage(src, imgTransform{width: 100, height: 100, fit: fitContain, gravity: gravity})
+		if _, _, _, a := img.At(50, transparentY).RGBA(); a != 0 {
+			t.Errorf("contain %s: pixel at y=%d isn't padding", gravity, transparentY)
+		}
+		if _, _, _, a := img.At(50, 100-transparentY).RGBA(); a == 0 {
+			t.Errorf("contain %s: pixel at y=%d is padding", gravity, 100-transparentY)
+		}
+	}
+}
+
+func absDiff(a uint8, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestParseTransformOptions(t *testing.T) {
+	avif := imgFormat{extension: ".avif", mimeType: "image/avif"}
+	normalize := func(options [][2]string) string {
+		t.Helper()
+		transform, _, err := parseTransformOptions(options)
+		if err != nil {
+			t.Fatalf("%v: %v", options, err)
+		}
+		return normalizeTransform(transform, avif)
+	}
+
+	equivalent := [][][2]string{
+		{{"w", "800"}, {"h", "600"}},
+		{{"h", "600"}, {"w", "800"}},
+		{{"h", "600"}, {"fit", "cover"}, {"w", "800"}, {"g", "center"}},
+	}
+	for _, options := range equivalent {
+		if got, want := normalize(options), "w:800,h:600,fit:cover,g:center,q:0,f:avif"; got != want {
+			t.Errorf("%v: got %s, want %s", options, got, want)
+		}
+	}
+	// The fit mode and gravity don't apply to a single dimension.
+	if a, b := normalize([][2]string{{"w", "800"}}), normalize([][2]string{{"g", "north"}, {"fit", "contain"}, {"w", "800"}}); a != b {
+		t.Errorf("got %s and %s for the same width", a, b)
+	}
+
+	for _, options := range [][][2]string{
+		{{"w", "0"}},
+		{{"w", "8193"}},
+		{{"w", "wide"}},
+		{{"h", "-1"}},
+		{{"fit", "zoom"}},
+		{{"g", "up"}},
+		{{"q", "0"}},
+		{{"q", "101"}},
+		{{"x", "1"}},
+	} {
+		if _, _, err := parseTransformOptions(options); err == nil {
+			t.Errorf("%v: expected an error", options)
+		}
+	}
+}